@@ -1,56 +1,134 @@
 package fac
 
 import (
-	"fmt"
 	"github.com/rwcarlsen/goclus/rsrc"
 	"github.com/rwcarlsen/goclus/rsrc/buff"
 	"github.com/rwcarlsen/goclus/sim"
 	"github.com/rwcarlsen/goclus/trans"
+	"log/slog"
 	"math"
 	"time"
 )
 
+func init() {
+	sim.Register(Fac{}, "fac")
+}
+
 type Fac struct {
 	sim.Agenty
 	queuedOrders []*sim.Message
+	// offered and requested are the quantities of the facility's orders
+	// not yet returned unfilled or transferred.
+	offered, requested float64
+	// matched are the matched requests whose resources have not arrived.
+	matched []match
 
-	InCommod string
-	InUnits  string
-	InSize   float64
+	InCommod string  `desc:"commodity requested from the market of the same name"`
+	InUnits  string  `desc:"units of measure of requested resources"`
+	InSize   float64 `desc:"input buffer capacity, in InUnits" min:"0"`
 	inBuff   *buff.Buffer
 
-	OutCommod string
-	OutUnits  string
-	OutSize   float64
+	OutCommod string  `desc:"commodity offered to the market of the same name"`
+	OutUnits  string  `desc:"units of measure of offered resources"`
+	OutSize   float64 `desc:"output buffer capacity, in OutUnits" min:"0"`
 	outBuff   *buff.Buffer
 
-	CreateRate    float64
-	ConvertAmt    float64
-	ConvertPeriod time.Duration
-	ConvertOffset time.Duration
+	CreateRate float64 `desc:"quantity of output (in OutUnits) created from nothing each time step" min:"0"`
+	ConvertAmt float64 `desc:"maximum quantity of input (in InUnits) converted to output per conversion" min:"0"`
+	// ConvertPeriod is the time between successive conversions of input
+	// to output resources.  It defaults to the engine's time step.
+	// Conversions happen in the Tock phase of the time step they are due in
+	// (or the next time step if they are due between two).
+	ConvertPeriod time.Duration `desc:"time between conversions; defaults to the time step" min:"0"`
+	// ConvertOffset shifts the conversion times: conversions are due when
+	// the time since the start of the simulation plus ConvertOffset is a
+	// multiple of ConvertPeriod.
+	ConvertOffset time.Duration `desc:"conversions are due when the time since the simulation start plus this is a multiple of ConvertPeriod" min:"0"`
+	convEv        *sim.Event
+	convDue       int // conversions due in the next Tock
 	eng           *sim.Engine
+	log           *slog.Logger
+}
+
+// match records a matched request returned to the facility.
+type match struct {
+	Qty  float64
+	Time time.Time
 }
 
 func (f *Fac) Start(e *sim.Engine) {
 	f.eng = e
+	f.log = e.Logger(f)
 	f.inBuff = &buff.Buffer{}
 	f.inBuff.SetCapacity(f.InSize)
 	f.outBuff = &buff.Buffer{}
 	f.outBuff.SetCapacity(f.OutSize)
+
+	if f.ConvertPeriod <= 0 {
+		f.ConvertPeriod = e.Step
+	}
+	if f.ConvertAmt > 0 {
+		var wait time.Duration
+		if rem := (e.SinceStart() + f.ConvertOffset) % f.ConvertPeriod; rem > 0 {
+			wait = f.ConvertPeriod - rem
+		}
+		f.convEv = e.ScheduleIn(wait, f.convert)
+	}
+}
+
+// End stops the facility's periodic conversions.
+func (f *Fac) End(e *sim.Engine) {
+	if f.convEv != nil {
+		f.convEv.Cancel()
+	}
 }
 
 func (f *Fac) Tick() {
+	f.releaseMatches()
+
 	// make offers
-	qty := f.outBuff.Qty()
+	qty := f.outBuff.Qty() - f.offered
 	if qty > rsrc.EPS {
 		f.genMsg(f.OutCommod, qty, trans.Offer)
+		f.offered += qty
 	}
 
 	// make requests
-	qty = f.inBuff.Space()
+	qty = f.inBuff.Space() - f.requested
 	if qty > rsrc.EPS {
 		f.genMsg(f.InCommod, qty, trans.Request)
+		f.requested += qty
+	}
+}
+
+// releaseMatches stops counting matched requests as outstanding if their
+// resources did not arrive within a time step (e.g. because their supplier
+// was decommissioned).
+func (f *Fac) releaseMatches() {
+	now := f.eng.Time()
+	pending := []match{}
+	for _, mt := range f.matched {
+		if mt.Time.Add(f.eng.Step).After(now) {
+			pending = append(pending, mt)
+			continue
+		}
+		f.log.Debug("matched request not transferred", "commod", f.InCommod, "qty", mt.Qty)
+		f.requested = math.Max(0, f.requested-mt.Qty)
+	}
+	f.matched = pending
+}
+
+// Commods returns the commodities the facility requests and offers (those
+// it has buffer capacity for).
+func (f *Fac) Commods() []string {
+	commods := []string{}
+	if f.InSize > 0 {
+		commods = append(commods, f.InCommod)
+	}
+	if f.OutSize > 0 {
+		commods = append(commods, f.OutCommod)
 	}
+	return commods
 }
 
 func (f *Fac) genMsg(commod string, qty float64, t trans.TransType) {
@@ -70,12 +148,10 @@ func (f *Fac) genMsg(commod string, qty float64, t trans.TransType) {
 }
 
 func (f *Fac) Tock() {
-	if f.ConvertPeriod == 0 {
-		f.ConvertPeriod = f.eng.Step
-	}
-
 	f.approveOffers()
-	f.convertRes()
+	for ; f.convDue > 0; f.convDue-- {
+		f.convertRes()
+	}
 
 	qty := math.Min(f.CreateRate, f.outBuff.Space())
 	f.createRes(qty)
@@ -83,7 +159,10 @@ func (f *Fac) Tock() {
 
 func (f *Fac) approveOffers() {
 	for _, m := range f.queuedOrders {
-		m.Trans.Approve()
+		if err := m.Trans.Approve(); err != nil {
+			f.log.Warn("transaction not recorded", "commod", f.OutCommod, "err", err)
+		}
+		f.offered = math.Max(0, f.offered-m.Trans.Resource().Qty())
 	}
 	f.queuedOrders = sim.MsgGroup{}
 }
@@ -96,16 +175,18 @@ func (f *Fac) createRes(qty float64) {
 	f.outBuff.Push(r)
 }
 
+// convert is scheduled to run every ConvertPeriod.  It defers the
+// conversion to the facility's next Tock.
+func (f *Fac) convert() {
+	f.convDue++
+	f.convEv = f.eng.ScheduleIn(f.ConvertPeriod, f.convert)
+}
+
 func (f *Fac) convertRes() {
 	qty := math.Min(f.ConvertAmt, f.outBuff.Space())
 	qty = math.Min(qty, f.inBuff.Qty())
-
-	now := int64(f.eng.SinceStart())
-	rem := (now + int64(f.ConvertOffset)) % int64(f.ConvertPeriod)
 	if qty <= rsrc.EPS {
 		return
-	} else if rem > 0 {
-		return
 	}
 
 	rs, err := f.inBuff.PopQty(qty)
@@ -117,23 +198,83 @@ func (f *Fac) convertRes() {
 	}
 }
 
+// Receive handles the facility's orders returned by markets.  Matched
+// offers are approved in Tock; matched requests are approved by their
+// suppliers.  Matched orders remain outstanding until they are approved
+// so that their quantities aren't ordered again in the meantime - matched
+// requests for at most a time step.
 func (f *Fac) Receive(m *sim.Message) {
-	if m.Sender() == f {
+	if m.Sender() != f {
+		return
+	}
+
+	reason := m.Rejection()
+	if m.Trans.Type() == trans.Request && reason != "" {
+		f.log.Debug("order rejected", "commod", f.InCommod, "reason", reason)
+		f.requested = math.Max(0, f.requested-m.Trans.Resource().Qty())
+	} else if reason != "" {
+		f.log.Debug("order rejected", "commod", f.OutCommod, "reason", reason)
+		f.offered = math.Max(0, f.offered-m.Trans.Resource().Qty())
+	} else if m.Trans.Type() == trans.Offer {
 		f.queuedOrders = append(f.queuedOrders, m)
+	} else {
+		f.matched = append(f.matched, match{Qty: m.Trans.Resource().Qty(), Time: f.eng.Time()})
 	}
 }
 
+// SaveState saves the facility's inventories, orders and next conversion
+// time.
+func (f *Fac) SaveState(s *sim.State) {
+	s.PutResources("inBuff", f.inBuff.Resources())
+	s.PutResources("outBuff", f.outBuff.Resources())
+	s.PutMsgs("queuedOrders", f.queuedOrders)
+	s.Put("offered", f.offered)
+	s.Put("requested", f.requested)
+	s.Put("matched", f.matched)
+	s.PutEvent("nextConvert", f.convEv)
+	s.Put("convertDue", f.convDue)
+}
+
+// LoadState restores state saved by SaveState.
+func (f *Fac) LoadState(s *sim.State) {
+	if err := f.inBuff.Push(s.Resources("inBuff")...); err != nil {
+		s.Fail(err)
+	}
+	if err := f.outBuff.Push(s.Resources("outBuff")...); err != nil {
+		s.Fail(err)
+	}
+	f.queuedOrders = s.Msgs("queuedOrders")
+	s.Get("offered", &f.offered)
+	s.Get("requested", &f.requested)
+	s.Get("matched", &f.matched)
+
+	if f.convEv != nil {
+		f.convEv.Cancel()
+	}
+	f.convEv = s.Event("nextConvert", f.convert)
+	s.Get("convertDue", &f.convDue)
+}
+
 func (f *Fac) RemoveResource(tran *trans.Transaction) {
-	fmt.Println(f.Id(), " sending qty=", tran.Resource().Qty(), "of", f.OutCommod)
+	f.log.Debug("sending", "qty", tran.Resource().Qty(), "commod", f.OutCommod)
 	rs, err := f.outBuff.PopQty(tran.Resource().Qty())
 	check(err)
 	tran.Manifest = rs
 }
 
 func (f *Fac) AddResource(tran *trans.Transaction) {
-	fmt.Println(f.Id(), " getting qty=", tran.Resource().Qty(), "of", f.InCommod)
+	f.log.Debug("receiving", "qty", tran.Resource().Qty(), "commod", f.InCommod)
 	err := f.inBuff.Push(tran.Manifest...)
 	check(err)
+
+	qty := tran.Resource().Qty()
+	f.requested = math.Max(0, f.requested-qty)
+	for i, mt := range f.matched {
+		if math.Abs(mt.Qty-qty) < rsrc.EPS {
+			f.matched = append(f.matched[:i:i], f.matched[i+1:]...)
+			break
+		}
+	}
 }
 
 func check(err error) {
@@ -0,0 +1,139 @@
+package fac
+
+import (
+	"fmt"
+	"github.com/rwcarlsen/goclus/agents/mkt"
+	"github.com/rwcarlsen/goclus/rsrc"
+	"github.com/rwcarlsen/goclus/sim"
+	"github.com/rwcarlsen/goclus/trans"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watcher is a test agent that checks the outstanding orders of a supplier
+// and a requester facility in every Report phase.
+type watcher struct {
+	sim.Agenty
+	src, snk *Fac
+	errs     []string
+}
+
+func (w *watcher) Report() {
+	if w.src.offered > w.src.outBuff.Qty() {
+		w.errs = append(w.errs, fmt.Sprint("offered ", w.src.offered, " of ", w.src.outBuff.Qty()))
+	}
+	if w.snk.requested > w.snk.inBuff.Space() {
+		w.errs = append(w.errs, fmt.Sprint("requested ", w.snk.requested, " for ", w.snk.inBuff.Space()))
+	}
+}
+
+// stock is a test agent that logs a facility's output inventory in every
+// Tick and Report phase.
+type stock struct {
+	sim.Agenty
+	f   *Fac
+	eng *sim.Engine
+	log []string
+}
+
+func (s *stock) Tick() {
+	s.log = append(s.log, fmt.Sprint(s.eng.SinceStart(), " tick ", s.f.outBuff.Qty()))
+}
+func (s *stock) Report() {
+	s.log = append(s.log, fmt.Sprint(s.eng.SinceStart(), " report ", s.f.outBuff.Qty()))
+}
+
+type transCounter struct{ n int }
+
+func (c *transCounter) TransNotify(*trans.Transaction) { c.n++ }
+
+func TestOutstandingOrders(t *testing.T) {
+	for _, latency := range []time.Duration{0, 10 * time.Minute} {
+		eng := &sim.Engine{Duration: 12 * time.Hour, Step: time.Hour, AsyncMsgs: latency > 0, MsgLatency: latency}
+		eng.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+		c := &transCounter{}
+		eng.ListenTrans(c)
+
+		m := &mkt.Mkt{}
+		m.SetName("milk")
+		assert.NoErr(t, eng.RegisterService(m)).Fatal()
+		eng.RegisterAll(m)
+		src := &Fac{OutCommod: "milk", OutUnits: "kg", OutSize: 12, CreateRate: 3}
+		snk := &Fac{InCommod: "milk", InUnits: "kg", InSize: 12}
+		eng.RegisterAll(src)
+		eng.RegisterAll(snk)
+		w := &watcher{src: src, snk: snk}
+		eng.RegisterAll(w)
+		// the source creates just enough to fill the sink
+		eng.ScheduleIn(4*time.Hour, func() { src.CreateRate = 0 })
+		eng.Run()
+
+		// orders never exceeded the facilities' inventory or space
+		assert.Eq(t, strings.Join(w.errs, "; "), "")
+
+		// the sink is filled in pieces and all orders have come back
+		assert.Eq(t, c.n > 2, true)
+		assert.Eq(t, snk.inBuff.Qty(), 12.0)
+		assert.Eq(t, src.outBuff.Qty(), 0.0)
+		assert.Eq(t, src.offered, 0.0)
+		assert.Eq(t, snk.requested, 0.0)
+	}
+}
+
+func TestDecommissionedSupplier(t *testing.T) {
+	eng := &sim.Engine{Duration: 12 * time.Hour, Step: time.Hour, AsyncMsgs: true, MsgLatency: 10 * time.Minute}
+	eng.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	m := &mkt.Mkt{}
+	m.SetName("milk")
+	assert.NoErr(t, eng.RegisterService(m)).Fatal()
+	eng.RegisterAll(m)
+	src1 := &Fac{OutCommod: "milk", OutUnits: "kg", OutSize: 5, CreateRate: 5}
+	src2 := &Fac{OutCommod: "milk", OutUnits: "kg", OutSize: 5, CreateRate: 5}
+	snk := &Fac{InCommod: "milk", InUnits: "kg", InSize: 10}
+	eng.RegisterAll(src1)
+	eng.RegisterAll(snk)
+
+	// src1's offer is matched at 2h but it is gone before the match
+	// reaches it
+	eng.DecommissionAt(eng.Time().Add(125*time.Minute), src1)
+	eng.DeployAt(eng.Time().Add(3*time.Hour), src2)
+	eng.Run()
+
+	// the sink orders the quantity src1 never sent again
+	assert.Eq(t, snk.inBuff.Qty(), 10.0)
+	assert.Eq(t, len(snk.matched), 0)
+}
+
+func TestConvertTiming(t *testing.T) {
+	eng := &sim.Engine{Duration: 5 * time.Hour, Step: time.Hour}
+	eng.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	for _, commod := range []string{"in", "out"} {
+		m := &mkt.Mkt{}
+		m.SetName(commod)
+		assert.NoErr(t, eng.RegisterService(m)).Fatal()
+		eng.RegisterAll(m)
+	}
+	f := &Fac{
+		InCommod: "in", InUnits: "kg", InSize: 10,
+		OutCommod: "out", OutUnits: "kg", OutSize: 10,
+		ConvertAmt: 2, ConvertPeriod: 2 * time.Hour, ConvertOffset: time.Hour,
+	}
+	eng.RegisterAll(f)
+	assert.NoErr(t, f.inBuff.Push(rsrc.NewGeneric(10, "kg"))).Fatal()
+	s := &stock{f: f, eng: eng}
+	eng.RegisterAll(s)
+	eng.Run()
+
+	// conversions are due at 1h and 3h and happen in Tock
+	assert.Eq(t, strings.Join(s.log, "\n"), strings.Join([]string{
+		"0s tick 0", "0s report 0",
+		"1h0m0s tick 0", "1h0m0s report 2",
+		"2h0m0s tick 2", "2h0m0s report 2",
+		"3h0m0s tick 2", "3h0m0s report 4",
+		"4h0m0s tick 4", "4h0m0s report 4",
+	}, "\n"))
+}
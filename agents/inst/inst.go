@@ -0,0 +1,28 @@
+// Package inst provides a pass-through agent for grouping other agents,
+// e.g. into regions and institutions.
+package inst
+
+import (
+	"github.com/rwcarlsen/goclus/sim"
+)
+
+func init() {
+	sim.Register(Inst{}, "inst")
+}
+
+// Inst forwards every message it receives along the message's path.  Agents
+// deployed as an Inst's children therefore send their messages (via the
+// Inst and its own parents) to their receivers unchanged.
+type Inst struct {
+	sim.Agenty
+}
+
+func (in *Inst) Receive(m *sim.Message) {
+	// messages to or returning to the Inst itself end here
+	if m.Dir == sim.UpMsg && m.Receiver() == sim.Agent(in) {
+		return
+	} else if m.Dir == sim.DownMsg && m.Sender() == sim.Agent(in) {
+		return
+	}
+	m.SendOn()
+}
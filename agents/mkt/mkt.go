@@ -4,18 +4,76 @@ import (
 	"github.com/rwcarlsen/goclus/rsrc"
 	"github.com/rwcarlsen/goclus/sim"
 	"github.com/rwcarlsen/goclus/trans"
-	"math/rand"
+	"math/rand/v2"
+	"time"
 )
 
+func init() {
+	sim.Register(Mkt{}, "mkt")
+}
+
+// Mkt matches the offers and requests (orders) it receives in its Resolve
+// phase.  Every order is eventually returned to its sender: the matched
+// part of an order is returned with its transaction matched (and a Fill
+// payload) - so an order matched against several others or only in part
+// is returned in several pieces.  The unmatched part of an order is
+// returned rejected as "unfilled" once it expires (see TTL).  Orders of
+// agents that are decommissioned before being matched are dropped.
 type Mkt struct {
 	sim.Agenty
-	Shuffle  bool
-	Seed     int64
+	Shuffle bool `desc:"match offers and requests in random order"`
+	// TTL is how long orders remain on the market: an order not (fully)
+	// matched in a Resolve phase is kept for matching in later Resolve
+	// phases that begin before TTL has elapsed since the order arrived.
+	// With the default of zero, orders are only matched in the Resolve
+	// phase following their arrival.  If the engine delays messages (see
+	// sim.Engine.MsgLatency), an order is kept through a second Resolve
+	// phase regardless of TTL - so that orders arriving after their time
+	// step's Resolve phase can still meet the orders sent in the next time
+	// step.
+	TTL time.Duration `desc:"how long unmatched orders remain on the market" min:"0"`
+	// Seed is accepted for compatibility with older inputs.
+	//
+	// Deprecated: Seed is ignored; markets shuffle orders with their
+	// random stream derived from the engine's Seed (see sim.Engine.Rand).
+	Seed     int64 `desc:"deprecated and ignored - see the engine's Seed"`
 	offers   sim.MsgGroup
 	requests sim.MsgGroup
+	arrived  map[*sim.Message]*arrival
+	rng      *rand.Rand
+	eng      *sim.Engine
+}
+
+// arrival records when an order on the market arrived.
+type arrival struct {
+	Time time.Time
+	// Resolved is whether the order was on the market during a previous
+	// Resolve phase.
+	Resolved bool
+}
+
+// Fill is the Payload of every order a Mkt returns to its sender (replacing
+// any payload set by the sender).
+type Fill struct {
+	// Qty is the matched quantity (i.e. the quantity of the returned
+	// transaction) or zero if the order is returned unfilled.
+	Qty float64
+	// Remaining is the quantity of the order still on the market.  It is
+	// non-zero for partially filled orders.
+	Remaining float64
+}
+
+func (m *Mkt) Start(e *sim.Engine) {
+	m.eng = e
+	m.rng = e.Rand(m)
+	if m.Seed != 0 {
+		e.Logger(m).Warn("Seed is deprecated and ignored; set the engine's Seed instead")
+	}
+	m.arrived = map[*sim.Message]*arrival{}
 }
 
 func (m *Mkt) Receive(mg *sim.Message) {
+	m.arrived[mg] = &arrival{Time: m.eng.Time()}
 	if mg.Trans.Type() == trans.Offer {
 		m.offers = append(m.offers, mg)
 	} else {
@@ -24,22 +82,69 @@ func (m *Mkt) Receive(mg *sim.Message) {
 }
 
 func (m *Mkt) Resolve() {
+	m.offers = m.dropOrphans(m.offers)
+	m.requests = m.dropOrphans(m.requests)
 	if m.Shuffle {
-		shuffle(m.offers)
-		shuffle(m.requests)
+		shuffle(m.rng, m.offers)
+		shuffle(m.rng, m.requests)
 	}
 
-	var matched sim.MsgGroup
-	for len(m.requests) > 0 && len(m.offers) > 0 {
-		mg := m.requests[0]
+	var matched, unfilled sim.MsgGroup
+	for _, mg := range m.requests {
 		qty := mg.Trans.Resource().Qty()
 		m.offers, matched = m.extractQty(m.offers, qty)
+		if len(matched) == 0 {
+			unfilled = append(unfilled, mg)
+			continue
+		}
 		m.matchAll(matched, mg)
-		m.requests = m.requests[1:]
+
+		filled := 0.0
+		for _, offer := range matched {
+			filled += offer.Trans.Resource().Qty()
+		}
+		if qty-filled < rsrc.EPS {
+			m.fill(mg)
+		} else {
+			m.fill(m.extractFromMsg(mg, filled))
+			unfilled = append(unfilled, mg)
+		}
+	}
+
+	m.requests = m.expire(unfilled)
+	m.offers = m.expire(m.offers)
+}
+
+// SaveState saves the market's unresolved offers and requests.
+func (m *Mkt) SaveState(s *sim.State) {
+	s.PutMsgs("offers", m.offers)
+	s.PutMsgs("requests", m.requests)
+	s.Put("offersArrived", m.arrivals(m.offers))
+	s.Put("requestsArrived", m.arrivals(m.requests))
+}
+
+// LoadState restores state saved by SaveState.
+func (m *Mkt) LoadState(s *sim.State) {
+	m.offers = s.Msgs("offers")
+	m.requests = s.Msgs("requests")
+
+	var offers, requests []*arrival
+	s.Get("offersArrived", &offers)
+	s.Get("requestsArrived", &requests)
+	for i, a := range offers {
+		m.arrived[m.offers[i]] = a
 	}
+	for i, a := range requests {
+		m.arrived[m.requests[i]] = a
+	}
+}
 
-	m.offers = sim.MsgGroup{}
-	m.requests = sim.MsgGroup{}
+func (m *Mkt) arrivals(group sim.MsgGroup) []*arrival {
+	arrivals := []*arrival{}
+	for _, mg := range group {
+		arrivals = append(arrivals, m.arrived[mg])
+	}
+	return arrivals
 }
 
 func (m *Mkt) matchAll(group sim.MsgGroup, mg *sim.Message) {
@@ -48,9 +153,56 @@ func (m *Mkt) matchAll(group sim.MsgGroup, mg *sim.Message) {
 		if err != nil {
 			panic(err.Error())
 		}
-		gpMem.Dir = sim.DownMsg
-		gpMem.SendOn()
+		m.fill(gpMem)
+	}
+}
+
+// fill returns the matched order mg to its sender.
+func (m *Mkt) fill(mg *sim.Message) {
+	f := &Fill{Qty: mg.Trans.Resource().Qty()}
+	if _, ok := m.arrived[mg]; ok {
+		delete(m.arrived, mg)
+	} else if split, ok := mg.Payload.(*Fill); ok {
+		// the remainder of an order split by extractFromMsg
+		f.Remaining = split.Remaining
+	}
+	mg.Payload = f
+	mg.Dir = sim.DownMsg
+	mg.SendOn()
+}
+
+// dropOrphans removes the orders of senders that have been decommissioned
+// from group and returns the rest.
+func (m *Mkt) dropOrphans(group sim.MsgGroup) sim.MsgGroup {
+	kept := sim.MsgGroup{}
+	for _, mg := range group {
+		if m.eng.IsDeployed(mg.Sender()) {
+			kept = append(kept, mg)
+		} else {
+			delete(m.arrived, mg)
+		}
+	}
+	return kept
+}
+
+// expire returns the orders in group that have expired to their senders
+// as unfilled and returns the rest.
+func (m *Mkt) expire(group sim.MsgGroup) sim.MsgGroup {
+	now := m.eng.Time()
+	kept := sim.MsgGroup{}
+	for _, mg := range group {
+		a := m.arrived[mg]
+		grace := !a.Resolved && m.eng.MsgLatency > 0
+		if grace || a.Time.Add(m.TTL).After(now) {
+			a.Resolved = true
+			kept = append(kept, mg)
+			continue
+		}
+		delete(m.arrived, mg)
+		mg.Payload = &Fill{}
+		mg.Reject("unfilled")
 	}
+	return kept
 }
 
 func (m *Mkt) extractQty(group sim.MsgGroup, qty float64) (orig, extracted sim.MsgGroup) {
@@ -77,12 +229,13 @@ func (m *Mkt) extractFromMsg(mg *sim.Message, qty float64) *sim.Message {
 
 	remainder := mg.Trans.Resource().Qty() - qty
 	mg.Trans.Resource().SetQty(remainder)
+	extracted.Payload = &Fill{Remaining: remainder}
 
 	return extracted
 }
 
-func shuffle(gp sim.MsgGroup) {
-	inds := rand.Perm(len(gp))
+func shuffle(rng *rand.Rand, gp sim.MsgGroup) {
+	inds := rng.Perm(len(gp))
 	orig := make(sim.MsgGroup, len(gp))
 	copy(orig, gp)
 
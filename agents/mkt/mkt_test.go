@@ -0,0 +1,289 @@
+package mkt
+
+import (
+	"fmt"
+	"github.com/rwcarlsen/goclus/rsrc"
+	"github.com/rwcarlsen/goclus/sim"
+	"github.com/rwcarlsen/goclus/trans"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returned holds the log of every trader by name at the time it ended.
+var returned map[string][]string
+
+// trader is a test agent that sends orders to markets and logs the orders
+// returned to it.  If configured, it sends an offer and/or request to the
+// "mkt" service in its Tick at time At.
+type trader struct {
+	sim.Agenty
+	Offer   float64
+	Request float64
+	At      time.Duration
+	got     []*sim.Message
+	log     []string
+	eng     *sim.Engine
+}
+
+func (tr *trader) Start(e *sim.Engine)               { tr.eng = e }
+func (tr *trader) RemoveResource(*trans.Transaction) {}
+func (tr *trader) AddResource(*trans.Transaction)    {}
+
+func (tr *trader) Tick() {
+	if tr.eng.SinceStart() != tr.At {
+		return
+	}
+	m, _ := tr.eng.GetService("mkt")
+	if tr.Offer > 0 {
+		tr.order(m, trans.Offer, tr.Offer)
+	}
+	if tr.Request > 0 {
+		tr.order(m, trans.Request, tr.Request)
+	}
+}
+
+func (tr *trader) Receive(mg *sim.Message) {
+	tr.got = append(tr.got, mg)
+	f := mg.Payload.(*Fill)
+	tr.log = append(tr.log, fmt.Sprintf("%v qty=%v remaining=%v %v",
+		tr.eng.SinceStart(), f.Qty, f.Remaining, mg.Rejection()))
+}
+
+func (tr *trader) End(e *sim.Engine) {
+	if returned != nil {
+		returned[tr.Name()] = tr.log
+	}
+}
+
+func (tr *trader) order(m sim.Agent, tp trans.TransType, qty float64) {
+	tran := trans.NewRequest(tr)
+	if tp == trans.Offer {
+		tran = trans.NewOffer(tr)
+	}
+	tran.SetResource(rsrc.NewGeneric(qty, "kg"))
+	mg := sim.NewMsg(tr, m)
+	mg.Trans = tran
+	mg.SendOn()
+}
+
+func newMkt(eng *sim.Engine, ttl time.Duration) *Mkt {
+	m := &Mkt{TTL: ttl}
+	m.SetName("mkt")
+	eng.RegisterAll(m)
+	return m
+}
+
+func newTrader(eng *sim.Engine) *trader {
+	tr := &trader{}
+	eng.RegisterAll(tr)
+	return tr
+}
+
+func TestMatch(t *testing.T) {
+	eng := &sim.Engine{}
+	m := newMkt(eng, 0)
+	sup, req := newTrader(eng), newTrader(eng)
+	sup.order(m, trans.Offer, 5)
+	req.order(m, trans.Request, 5)
+	m.Resolve()
+
+	assert.Eq(t, len(sup.got), 1).Fatal()
+	assert.Eq(t, len(req.got), 1).Fatal()
+	assert.Eq(t, *sup.got[0].Payload.(*Fill), Fill{Qty: 5})
+	assert.Eq(t, *req.got[0].Payload.(*Fill), Fill{Qty: 5})
+	assert.Eq(t, sup.got[0].Rejection(), "")
+	assert.Eq(t, sup.got[0].Trans.Req, trans.Requester(req))
+	assert.Eq(t, req.got[0].Trans.Sup, trans.Supplier(sup))
+	assert.Eq(t, len(m.offers)+len(m.requests)+len(m.arrived), 0)
+}
+
+func TestPartialRequest(t *testing.T) {
+	eng := &sim.Engine{}
+	m := newMkt(eng, 0)
+	sup, req := newTrader(eng), newTrader(eng)
+	sup.order(m, trans.Offer, 3)
+	req.order(m, trans.Request, 5)
+	m.Resolve()
+
+	assert.Eq(t, len(sup.got), 1).Fatal()
+	assert.Eq(t, len(req.got), 2).Fatal()
+	assert.Eq(t, *sup.got[0].Payload.(*Fill), Fill{Qty: 3})
+	assert.Eq(t, *req.got[0].Payload.(*Fill), Fill{Qty: 3, Remaining: 2})
+	assert.Eq(t, req.got[0].Trans.Resource().Qty(), 3.0)
+	assert.Eq(t, req.got[0].Trans.Sup, trans.Supplier(sup))
+
+	// the remainder is returned unfilled after the Resolve
+	assert.Eq(t, *req.got[1].Payload.(*Fill), Fill{})
+	assert.Eq(t, req.got[1].Rejection(), "unfilled")
+	assert.Eq(t, req.got[1].Trans.Resource().Qty(), 2.0)
+	assert.Eq(t, len(m.requests)+len(m.arrived), 0)
+}
+
+func TestZeroTTL(t *testing.T) {
+	eng := &sim.Engine{Duration: 3 * time.Hour, Step: time.Hour}
+	m := newMkt(eng, 0)
+	sup, req := newTrader(eng), newTrader(eng)
+	req.order(m, trans.Request, 1)
+	eng.ScheduleIn(time.Hour, func() { sup.order(m, trans.Offer, 1) })
+	eng.Run()
+
+	// neither order is kept past the first Resolve after it arrived
+	assert.Eq(t, strings.Join(req.log, "\n"), "0s qty=0 remaining=0 unfilled")
+	assert.Eq(t, strings.Join(sup.log, "\n"), "1h0m0s qty=0 remaining=0 unfilled")
+}
+
+func TestSplitOffer(t *testing.T) {
+	eng := &sim.Engine{}
+	m := newMkt(eng, time.Hour)
+	sup, req1, req2 := newTrader(eng), newTrader(eng), newTrader(eng)
+	sup.order(m, trans.Offer, 10)
+	req1.order(m, trans.Request, 4)
+	req2.order(m, trans.Request, 3)
+	m.Resolve()
+
+	assert.Eq(t, len(req1.got), 1).Fatal()
+	assert.Eq(t, len(req2.got), 1).Fatal()
+	assert.Eq(t, *req1.got[0].Payload.(*Fill), Fill{Qty: 4})
+	assert.Eq(t, *req2.got[0].Payload.(*Fill), Fill{Qty: 3})
+
+	assert.Eq(t, len(sup.got), 2).Fatal()
+	assert.Eq(t, *sup.got[0].Payload.(*Fill), Fill{Qty: 4, Remaining: 6})
+	assert.Eq(t, *sup.got[1].Payload.(*Fill), Fill{Qty: 3, Remaining: 3})
+	assert.Eq(t, sup.got[0].Trans.Req, trans.Requester(req1))
+	assert.Eq(t, sup.got[1].Trans.Req, trans.Requester(req2))
+
+	// the remainder stays on the market until its TTL elapses
+	assert.Eq(t, len(m.offers), 1).Fatal()
+	assert.Eq(t, m.offers[0].Trans.Resource().Qty(), 3.0)
+}
+
+func TestDecommissionedSender(t *testing.T) {
+	eng := &sim.Engine{}
+	m := newMkt(eng, time.Hour)
+	sup, req := newTrader(eng), newTrader(eng)
+	sup.order(m, trans.Offer, 1)
+	m.Resolve()
+	eng.Decommission(sup)
+	req.order(m, trans.Request, 1)
+	m.Resolve()
+
+	// the offer of the decommissioned supplier is no longer matched
+	assert.Eq(t, len(sup.got), 0)
+	assert.Eq(t, len(req.got), 0)
+	assert.Eq(t, len(m.offers), 0)
+	assert.Eq(t, len(m.arrived), 1)
+}
+
+func TestTTL(t *testing.T) {
+	eng := &sim.Engine{Duration: 6 * time.Hour, Step: time.Hour}
+	m := newMkt(eng, 150*time.Minute)
+	sup, req1, req2 := newTrader(eng), newTrader(eng), newTrader(eng)
+	req1.order(m, trans.Request, 1)
+	req2.order(m, trans.Request, 1)
+	eng.ScheduleIn(2*time.Hour, func() { sup.order(m, trans.Offer, 1) })
+	eng.Run()
+
+	// req1 is still on the market when the offer arrives; req2 expires
+	// 2.5h after it arrived
+	assert.Eq(t, strings.Join(req1.log, "\n"), "2h0m0s qty=1 remaining=0 ")
+	assert.Eq(t, strings.Join(req2.log, "\n"), "3h0m0s qty=0 remaining=0 unfilled")
+}
+
+func TestLatency(t *testing.T) {
+	eng := &sim.Engine{Duration: 4 * time.Hour, Step: time.Hour, AsyncMsgs: true, MsgLatency: 10 * time.Minute}
+	m := newMkt(eng, 0)
+	sup, req1, req2 := newTrader(eng), newTrader(eng), newTrader(eng)
+	req1.order(m, trans.Request, 1)
+	req2.order(m, trans.Request, 1)
+	eng.ScheduleIn(time.Hour, func() { sup.order(m, trans.Offer, 1) })
+	eng.Run()
+
+	// the requests arrive after the first Resolve and the offer after the
+	// second, yet they meet in the third
+	assert.Eq(t, strings.Join(req1.log, "\n"), "2h10m0s qty=1 remaining=0 ")
+	assert.Eq(t, strings.Join(sup.log, "\n"), "2h10m0s qty=1 remaining=0 ")
+	assert.Eq(t, strings.Join(req2.log, "\n"), "2h10m0s qty=0 remaining=0 unfilled")
+}
+
+func TestCheckpoint(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "ck.json")
+	const tr = "github.com/rwcarlsen/goclus/agents/mkt.trader"
+	newLoader := func() *sim.Loader {
+		l := &sim.Loader{
+			Engine: &sim.Engine{
+				Duration:        6 * time.Hour,
+				Step:            time.Hour,
+				CheckpointEvery: 3 * time.Hour,
+				CheckpointFile:  fname,
+			},
+			Prototypes: map[string]*sim.ProtoInfo{
+				"mkt": {ImportPath: "github.com/rwcarlsen/goclus/agents/mkt.Mkt", Config: map[string]interface{}{"TTL": "4h"}},
+				// a's request is partially filled before the checkpoint at
+				// 3h and again after it; its remainder then expires
+				"a": {ImportPath: tr, Config: map[string]interface{}{"Request": 5, "At": "1h"}},
+				"b": {ImportPath: tr, Config: map[string]interface{}{"Offer": 2, "At": "2h"}},
+				"c": {ImportPath: tr, Config: map[string]interface{}{"Offer": 4, "At": "4h"}},
+				"d": {ImportPath: tr, Config: map[string]interface{}{"Request": 1.5, "At": "0h"}},
+			},
+			Agents: []*sim.AgentInfo{
+				{Name: "mkt", ProtoId: "mkt", IsService: true},
+				{Name: "a", ProtoId: "a"},
+				{Name: "b", ProtoId: "b"},
+				{Name: "c", ProtoId: "c"},
+				{Name: "d", ProtoId: "d"},
+			},
+		}
+		l.Register(trader{})
+		l.Engine.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+		return l
+	}
+
+	returned = map[string][]string{}
+	l := newLoader()
+	assert.NoErr(t, l.Build()).Fatal()
+	l.Engine.Run()
+	full := returned
+
+	returned = map[string][]string{}
+	l = newLoader()
+	assert.NoErr(t, l.Resume(fname)).Fatal()
+	assert.Eq(t, l.Engine.SinceStart(), 3*time.Hour)
+	l.Engine.Run()
+
+	assert.Eq(t, strings.Join(full["d"], "\n"), "2h0m0s qty=1.5 remaining=0 ")
+	assert.Eq(t, strings.Join(full["a"], "\n"), strings.Join([]string{
+		"2h0m0s qty=0.5 remaining=4.5 ",
+		"4h0m0s qty=4 remaining=0.5 ",
+		"5h0m0s qty=0 remaining=0 unfilled",
+	}, "\n"))
+	for _, name := range []string{"a", "b", "c", "d"} {
+		var after []string
+		for _, s := range full[name] {
+			if d, _ := time.ParseDuration(strings.Fields(s)[0]); d >= 3*time.Hour {
+				after = append(after, s)
+			}
+		}
+		assert.Eq(t, strings.Join(returned[name], "\n"), strings.Join(after, "\n"))
+	}
+}
+
+func TestDeprecatedSeed(t *testing.T) {
+	l := &sim.Loader{
+		Engine: &sim.Engine{Duration: time.Hour, Step: time.Hour},
+		Prototypes: map[string]*sim.ProtoInfo{
+			"mkt": {ImportPath: "github.com/rwcarlsen/goclus/agents/mkt.Mkt", Config: map[string]interface{}{"Seed": 7}},
+		},
+		Agents: []*sim.AgentInfo{{Name: "mkt", ProtoId: "mkt"}},
+	}
+	l.Engine.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+
+	// inputs setting the old Seed field still load
+	assert.NoErr(t, l.Validate())
+	assert.NoErr(t, l.Build()).Fatal()
+	l.Engine.Run()
+}
@@ -1,27 +0,0 @@
-package main
-
-import (
-	"fmt"
-	"github.com/rwcarlsen/goclus/agents/fac"
-	"github.com/rwcarlsen/goclus/agents/mkt"
-	"github.com/rwcarlsen/goclus/books"
-	"github.com/rwcarlsen/goclus/sim"
-)
-
-func registerAgents(l *sim.Loader) {
-	l.Register(fac.Fac{})
-	l.Register(mkt.Mkt{})
-	l.Register(books.Books{})
-}
-
-func main() {
-	// load simulation
-	l := &sim.Loader{}
-	registerAgents(l)
-	err := l.LoadSim("input.json")
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	l.Engine.Run()
-}
@@ -0,0 +1,315 @@
+// Package batch runs many independent realizations of a simulation
+// concurrently (e.g. for Monte Carlo ensembles).
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rwcarlsen/goclus/sim"
+	"io/ioutil"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Scenario describes one realization of a simulation.
+type Scenario struct {
+	// Name is the name of the scenario's output directory.
+	Name string
+	// Seed is the engine seed used for the scenario.
+	Seed int64
+	// Params are prototype configuration values that override those in the
+	// input file.
+	Params []sim.Setting
+}
+
+// Variation describes how a prototype configuration value varies between
+// the realizations of an ensemble.  If Values is non-empty, each
+// realization uses one of them chosen at random.  Otherwise each
+// realization uses a value drawn uniformly from [Min, Max).
+type Variation struct {
+	Proto    string
+	Field    string
+	Min, Max float64
+	Values   []interface{}
+}
+
+// Ensemble returns n scenarios with seeds seed, seed+1, ... and prototype
+// configuration values sampled (reproducibly for a given seed) according
+// to vary.
+func Ensemble(n int, seed int64, vary []Variation) []*Scenario {
+	rng := rand.New(rand.NewPCG(uint64(seed), 0))
+	width := len(fmt.Sprint(n - 1))
+
+	scens := []*Scenario{}
+	for i := 0; i < n; i++ {
+		sc := &Scenario{
+			Name: fmt.Sprintf("run%0*d", width, i),
+			Seed: seed + int64(i),
+		}
+		for _, v := range vary {
+			var val interface{}
+			if len(v.Values) > 0 {
+				val = v.Values[rng.IntN(len(v.Values))]
+			} else {
+				val = v.Min + rng.Float64()*(v.Max-v.Min)
+			}
+			sc.Params = append(sc.Params, sim.Setting{Proto: v.Proto, Field: v.Field, Value: val})
+		}
+		scens = append(scens, sc)
+	}
+	return scens
+}
+
+// Sweep returns n scenarios for each of the sweep points (as returned by
+// sim.Loader.SweepPoints).  The realizations of every point use seeds seed,
+// seed+1, ... so that differences between points are due to their
+// parameters alone.
+func Sweep(points [][]sim.Setting, n int, seed int64) []*Scenario {
+	pwidth, rwidth := len(fmt.Sprint(len(points)-1)), len(fmt.Sprint(n-1))
+
+	scens := []*Scenario{}
+	for p, pt := range points {
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("sweep%0*d", pwidth, p)
+			if n > 1 {
+				name += fmt.Sprintf("-run%0*d", rwidth, i)
+			}
+			scens = append(scens, &Scenario{Name: name, Seed: seed + int64(i), Params: pt})
+		}
+	}
+	return scens
+}
+
+// Result summarizes the outcome of running a single scenario.
+type Result struct {
+	*Scenario
+	// Dir is the directory the scenario's output was written to.
+	Dir string
+	// Err describes why the scenario failed to run (if it did).
+	Err string `json:",omitempty"`
+	// Transactions is the number of resource transfers recorded.
+	Transactions int
+	// Qty is the total quantity transferred for each unit of measure.
+	Qty map[string]float64
+	eng *sim.Engine // the scenario's engine while it runs
+}
+
+// Runner runs scenarios built from a common input file.
+type Runner struct {
+	// Input is the simulation input file.
+	Input string
+	// Format is the format of the input file (see sim.Loader.DecodeFormat).
+	// It defaults to the format implied by the file's extension.
+	Format string
+	// OutDir is the directory that contains each scenario's output
+	// directory.
+	OutDir string
+	// Workers is the number of scenarios run concurrently.  It defaults to
+	// the number of CPUs.
+	Workers int
+	// NewLoader, if not nil, returns a new loader with any agent types not
+	// registered with sim.Register registered.
+	NewLoader func() *sim.Loader
+	// Configure, if not nil, is called for every scenario after its input
+	// is decoded and the scenario's settings are applied, but before the
+	// simulation is built.
+	Configure func(*sim.Loader) error
+}
+
+// Run runs all scenarios and returns their results in the same order.  A
+// scenario that fails (or panics) does not prevent the others from running.
+func (r *Runner) Run(scens []*Scenario) []*Result {
+	workers := r.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	results := make([]*Result, len(scens))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = r.runOne(scens[i])
+			}
+		}()
+	}
+	for i := range scens {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func (r *Runner) runOne(sc *Scenario) (res *Result) {
+	res = &Result{Scenario: sc, Dir: filepath.Join(r.OutDir, sc.Name)}
+	defer func() {
+		if v := recover(); v != nil {
+			res.Err = fmt.Sprint(v)
+			abort(res.eng)
+		}
+		res.eng = nil
+	}()
+
+	if err := r.simulate(sc, res); err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	if err := res.tally(); err != nil {
+		res.Err = err.Error()
+	}
+	return res
+}
+
+// abort closes eng after a panic so that its agents (e.g. book-keepers)
+// release their goroutines and files.  Panics while closing are ignored.
+func abort(eng *sim.Engine) {
+	if eng == nil {
+		return
+	}
+	defer func() { recover() }()
+	eng.Close()
+}
+
+func (r *Runner) simulate(sc *Scenario, res *Result) error {
+	dir := res.Dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// tag the output with the scenario's parameters
+	data, err := json.MarshalIndent(sc, "", "\t")
+	if err != nil {
+		return err
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "scenario.json"), data, 0644); err != nil {
+		return err
+	}
+
+	format := r.Format
+	if format == "" {
+		format = sim.FormatOf(r.Input)
+	}
+	l := &sim.Loader{}
+	if r.NewLoader != nil {
+		l = r.NewLoader()
+	}
+	if err := l.DecodeFormat(r.Input, format); err != nil {
+		return err
+	}
+	res.eng = l.Engine
+	l.Engine.Seed = sc.Seed
+	l.Engine.OutDir = dir
+	if l.Engine.LogFile == "" {
+		l.Engine.LogFile = "sim.log"
+	}
+	for _, p := range sc.Params {
+		if err := l.SetConfig(p.Proto, p.Field, p.Value); err != nil {
+			return err
+		}
+	}
+	if r.Configure != nil {
+		if err := r.Configure(l); err != nil {
+			return err
+		}
+	}
+
+	if err := l.Build(); err != nil {
+		return err
+	}
+	l.Engine.Run()
+	return nil
+}
+
+// tally reads the transactions recorded in the result's output directory.
+func (res *Result) tally() error {
+	data, err := ioutil.ReadFile(filepath.Join(res.Dir, "trans.out"))
+	if err != nil {
+		return err
+	}
+	var trans []struct {
+		Qty   float64
+		Units string
+	}
+	if err := json.Unmarshal(data, &trans); err != nil {
+		return err
+	}
+
+	res.Transactions = len(trans)
+	res.Qty = map[string]float64{}
+	for _, t := range trans {
+		res.Qty[t.Units] += t.Qty
+	}
+	return nil
+}
+
+// Stats summarizes a quantity over all successful realizations.
+type Stats struct {
+	Mean, StdDev, Min, Max float64
+}
+
+// Summary describes an entire ensemble.
+type Summary struct {
+	Runs   int
+	Failed int
+	// Qty summarizes the total quantity transferred for each unit of measure.
+	Qty     map[string]*Stats
+	Results []*Result
+}
+
+// Summarize computes ensemble statistics for results.
+func Summarize(results []*Result) *Summary {
+	s := &Summary{Runs: len(results), Qty: map[string]*Stats{}, Results: results}
+
+	vals := map[string][]float64{}
+	ok := 0
+	for _, res := range results {
+		if res.Err != "" {
+			s.Failed++
+			continue
+		}
+		ok++
+		for units, qty := range res.Qty {
+			vals[units] = append(vals[units], qty)
+		}
+	}
+
+	for units, qtys := range vals {
+		// realizations without any transfers of units count as zero
+		for len(qtys) < ok {
+			qtys = append(qtys, 0)
+		}
+		s.Qty[units] = stats(qtys)
+	}
+	return s
+}
+
+// WriteSummary writes the ensemble summary to summary.json in dir.
+func WriteSummary(dir string, s *Summary) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "summary.json"), data, 0644)
+}
+
+func stats(vals []float64) *Stats {
+	sort.Float64s(vals)
+	st := &Stats{Min: vals[0], Max: vals[len(vals)-1]}
+	for _, v := range vals {
+		st.Mean += v
+	}
+	st.Mean /= float64(len(vals))
+	for _, v := range vals {
+		st.StdDev += (v - st.Mean) * (v - st.Mean)
+	}
+	st.StdDev = math.Sqrt(st.StdDev / float64(len(vals)))
+	return st
+}
@@ -0,0 +1,161 @@
+package batch
+
+import (
+	"errors"
+	"github.com/rwcarlsen/goclus/sim"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/rwcarlsen/goclus/agents/fac"
+	_ "github.com/rwcarlsen/goclus/agents/mkt"
+	_ "github.com/rwcarlsen/goclus/books"
+)
+
+const input = `{
+	"Engine": {"Duration": "6mo", "Step": "1mo"},
+	"Prototypes": {
+		"books": {"ImportPath": "books"},
+		"milk": {"ImportPath": "mkt", "Config": {"Shuffle": true}},
+		"src": {"ImportPath": "fac", "Config": {"OutCommod": "milk", "OutUnits": "gal", "OutSize": 100, "CreateRate": 5}},
+		"snk": {"ImportPath": "fac", "Config": {"InCommod": "milk", "InUnits": "gal", "InSize": 1000}}
+	},
+	"Agents": [
+		{"Name": "books", "ProtoId": "books"},
+		{"Name": "milk", "ProtoId": "milk", "IsService": true},
+		{"Name": "src", "ProtoId": "src"},
+		{"Name": "snk", "ProtoId": "snk"}
+	]
+}`
+
+// bomb is a test agent that panics when it ticks.
+type bomb struct{ sim.Agenty }
+
+func (b *bomb) Tick() { panic("boom") }
+
+func newRunner(t *testing.T, workers int) *Runner {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "input.json")
+	err := ioutil.WriteFile(in, []byte(input), 0644)
+	assert.NoErr(t, err).Fatal()
+	return &Runner{Input: in, OutDir: dir, Workers: workers}
+}
+
+func TestEnsemble(t *testing.T) {
+	vary := []Variation{
+		{Proto: "src", Field: "CreateRate", Min: 1, Max: 10},
+		{Proto: "snk", Field: "InUnits", Values: []interface{}{"gal", "kg"}},
+	}
+	s1 := Ensemble(12, 5, vary)
+	s2 := Ensemble(12, 5, vary)
+	s3 := Ensemble(12, 6, vary)
+	assert.Eq(t, len(s1), 12).Fatal()
+	assert.Eq(t, s1[0].Name, "run00")
+	assert.Eq(t, s1[11].Seed, int64(16))
+	for i := range s1 {
+		assert.Eq(t, s1[i].Seed, int64(5+i))
+		assert.Eq(t, s1[i].Params[0].Value, s2[i].Params[0].Value)
+		assert.Eq(t, s1[i].Params[1].Value, s2[i].Params[1].Value)
+		rate := s1[i].Params[0].Value.(float64)
+		assert.Eq(t, rate >= 1 && rate < 10, true)
+	}
+	assert.Ne(t, s1[0].Params[0].Value, s3[0].Params[0].Value)
+}
+
+func TestSweep(t *testing.T) {
+	points := [][]sim.Setting{
+		{{Proto: "src", Field: "CreateRate", Value: 1.0}},
+		{{Proto: "src", Field: "CreateRate", Value: 2.0}},
+	}
+	scens := Sweep(points, 3, 10)
+	assert.Eq(t, len(scens), 6).Fatal()
+	assert.Eq(t, scens[0].Name, "sweep0-run0")
+	assert.Eq(t, scens[5].Name, "sweep1-run2")
+	// realizations of every point share seeds
+	assert.Eq(t, scens[1].Seed, scens[4].Seed)
+	assert.Eq(t, scens[4].Params[0].Value, 2.0)
+
+	assert.Eq(t, Sweep(points, 1, 0)[1].Name, "sweep1")
+}
+
+func TestRunConcurrent(t *testing.T) {
+	scens := Ensemble(6, 1, []Variation{{Proto: "src", Field: "CreateRate", Min: 1, Max: 10}})
+	serial := newRunner(t, 1).Run(scens)
+	concurrent := newRunner(t, 4).Run(scens)
+	again := newRunner(t, 3).Run(scens)
+
+	assert.Eq(t, len(concurrent), len(serial)).Fatal()
+	for i := range serial {
+		assert.Eq(t, serial[i].Err, "")
+		assert.Eq(t, concurrent[i].Err, "")
+		assert.Eq(t, serial[i].Transactions > 0, true)
+		assert.Eq(t, concurrent[i].Transactions, serial[i].Transactions)
+		assert.Eq(t, concurrent[i].Qty["gal"], serial[i].Qty["gal"])
+		assert.Eq(t, again[i].Qty["gal"], serial[i].Qty["gal"])
+	}
+	// different rates transfer different quantities
+	assert.Ne(t, serial[0].Qty["gal"], serial[1].Qty["gal"])
+}
+
+func TestRunFailures(t *testing.T) {
+	r := newRunner(t, 2)
+	r.NewLoader = func() *sim.Loader {
+		l := &sim.Loader{}
+		l.Register(bomb{})
+		return l
+	}
+	r.Configure = func(l *sim.Loader) error {
+		switch l.Engine.Seed {
+		case 1:
+			return errors.New("bad scenario")
+		case 2:
+			l.Prototypes["bomb"] = &sim.ProtoInfo{ImportPath: "github.com/rwcarlsen/goclus/batch.bomb"}
+			l.Agents = append(l.Agents, &sim.AgentInfo{Name: "bomb", ProtoId: "bomb"})
+		}
+		return nil
+	}
+
+	results := r.Run(Ensemble(4, 0, nil))
+	assert.Eq(t, results[0].Err, "")
+	assert.Eq(t, results[1].Err, "bad scenario")
+	assert.Eq(t, strings.Contains(results[2].Err, "boom"), true)
+	assert.Eq(t, results[3].Err, "")
+	assert.Eq(t, results[3].Transactions > 0, true)
+
+	// the panicking realization's books were still written
+	_, err := os.Stat(filepath.Join(results[2].Dir, "agents.out"))
+	assert.NoErr(t, err)
+
+	s := Summarize(results)
+	assert.Eq(t, s.Runs, 4)
+	assert.Eq(t, s.Failed, 2)
+	assert.Eq(t, s.Qty["gal"].Mean, results[0].Qty["gal"])
+}
+
+func TestSummarize(t *testing.T) {
+	results := []*Result{
+		{Qty: map[string]float64{"kg": 2, "gal": 1}},
+		{Qty: map[string]float64{"kg": 4}},
+		{Qty: map[string]float64{"kg": 9}},
+		{Err: "failed", Qty: map[string]float64{"kg": 100}},
+	}
+	s := Summarize(results)
+	assert.Eq(t, s.Runs, 4)
+	assert.Eq(t, s.Failed, 1)
+
+	kg := s.Qty["kg"]
+	assert.Eq(t, kg.Mean, 5.0)
+	assert.Eq(t, kg.Min, 2.0)
+	assert.Eq(t, kg.Max, 9.0)
+	assert.Eq(t, math.Abs(kg.StdDev-math.Sqrt(26.0/3)) < 1e-12, true)
+
+	// realizations without transfers of a unit count as zero
+	gal := s.Qty["gal"]
+	assert.Eq(t, math.Abs(gal.Mean-1.0/3) < 1e-12, true)
+	assert.Eq(t, gal.Min, 0.0)
+	assert.Eq(t, gal.Max, 1.0)
+}
@@ -7,9 +7,14 @@ import (
 	"github.com/rwcarlsen/goclus/trans"
 	"os"
 	"reflect"
+	"sort"
 	"time"
 )
 
+func init() {
+	sim.Register(Books{}, "books")
+}
+
 // transData holds simulation transaction information in an
 // output-write-ready format.
 type transData struct {
@@ -29,7 +34,9 @@ type agentData struct {
 	Name     string
 	Type     string
 	Born     time.Time
+	Died     *time.Time `json:",omitempty"`
 	ParentId int
+	config   *sim.AgentConfig // effective configuration when deployed (see markServices)
 }
 
 // Books is an agent that records participating-agent and transaction activity
@@ -44,31 +51,46 @@ type Books struct {
 	eId      int // next trans entry id tracker
 	done     chan bool
 	transIn  chan *trans.Transaction
-	msgIn    chan *sim.Message
+	bornIn   chan *agentData
+	diedIn   chan *agentData
+	funcIn   chan func()
 	miscIn   chan interface{}
+	unsubs   []func()
 	tranDat  []*transData
 	agentDat map[int]*agentData
 	miscDat  []interface{}
+	// orphans holds the ids of agents deployed before their parent by
+	// parent.
+	orphans map[sim.Agent][]int
 }
 
 // Start spins off a goroutine that book-keeps all transaction and agent
-// information as provided via MsgNotify and TransNotify.
+// information as provided via TransNotify, Deployed and Decommissioned.
+// Agent information is written to agents.out, transactions to trans.out
+// and the effective configuration of the simulation and every agent (see
+// sim.SimConfig) to config.out.
 func (b *Books) Start(e *sim.Engine) {
-	sim.ListenAllMsg(b)
-	trans.ListenAll(b)
-
+	b.eng = e
 	b.done = make(chan bool)
 	b.agentDat = map[int]*agentData{}
+	b.orphans = map[sim.Agent][]int{}
 	b.transIn = make(chan *trans.Transaction)
-	b.msgIn = make(chan *sim.Message)
+	b.bornIn = make(chan *agentData)
+	b.diedIn = make(chan *agentData)
+	b.funcIn = make(chan func())
 	go func() {
 		for {
 			select {
 			case t := <-b.transIn:
 				b.regTrans(t)
-			case m := <-b.msgIn:
-				b.regAgent(m.PrevOwner)
-				b.regAgent(m.Owner)
+			case dat := <-b.bornIn:
+				b.agentDat[dat.Id] = dat
+			case dat := <-b.diedIn:
+				if a, ok := b.agentDat[dat.Id]; ok {
+					a.Died = dat.Died
+				}
+			case f := <-b.funcIn:
+				f()
 			case i := <-b.miscIn:
 				b.miscDat = append(b.miscDat, i)
 			case <-b.done:
@@ -76,20 +98,97 @@ func (b *Books) Start(e *sim.Engine) {
 			}
 		}
 	}()
+
+	b.unsubs = append(b.unsubs, e.ListenTrans(b), e.ListenDeploy(b))
 }
 
 // End allows final recording operations to take place before the
 // simulation closes; most notably, writing remaining collected information
 // to an output file.
 func (b *Books) End(e *sim.Engine) {
+	for _, unsub := range b.unsubs {
+		unsub()
+	}
 	b.done <- true
-	b.saveData()
+	b.markServices()
+	if err := b.saveData(); err != nil {
+		e.Logger(b).Error("cannot save books", "err", err)
+	}
 }
 
-// MsgNotify is used to collect information about agents participating in a
-// simulation from the sim.Engine.
-func (b *Books) MsgNotify(m *sim.Message) {
-	b.msgIn <- m
+// Deployed is used to record the deployment (and effective configuration)
+// of agents participating in a simulation from the sim.Engine.
+func (b *Books) Deployed(a sim.Agent) {
+	tp := reflect.Indirect(reflect.ValueOf(a)).Type()
+	dat := &agentData{
+		Id:   a.Id(),
+		Name: a.Name(),
+		Type: tp.PkgPath() + "." + tp.Name(),
+		Born: b.getTime(),
+	}
+	if par := a.Parent(); par != nil && par.Id() == 0 {
+		b.orphans[par] = append(b.orphans[par], a.Id())
+	} else if par != nil {
+		dat.ParentId = par.Id()
+	}
+
+	var err error
+	if dat.config, err = b.eng.AgentConfig(a); err != nil {
+		b.eng.Logger(b).Warn("cannot record agent config", "err", err)
+	}
+	b.bornIn <- dat
+
+	// children deployed before a were recorded without a parent id
+	if children, ok := b.orphans[a]; ok {
+		delete(b.orphans, a)
+		b.do(func() { b.setParent(children, a.Id()) })
+	}
+}
+
+// setParent records parent as the parent id of the agents with the given
+// ids.
+func (b *Books) setParent(ids []int, parent int) {
+	for _, id := range ids {
+		dat, ok := b.agentDat[id]
+		if !ok {
+			continue
+		}
+		dat.ParentId = parent
+		if dat.config != nil {
+			dat.config.ParentId = parent
+		}
+	}
+}
+
+// Decommissioned is used to record the removal of agents from a simulation
+// by the sim.Engine.
+func (b *Books) Decommissioned(a sim.Agent) {
+	t := b.getTime()
+	b.diedIn <- &agentData{Id: a.Id(), Died: &t}
+	b.do(func() {
+		if dat, ok := b.agentDat[a.Id()]; ok {
+			b.markService(dat)
+		}
+	})
+}
+
+// markServices records which agents are registered as services in their
+// configuration - agents are often registered after being deployed.
+func (b *Books) markServices() {
+	for _, dat := range b.agentDat {
+		b.markService(dat)
+	}
+}
+
+// markService records whether the agent of dat is registered as a service
+// in its configuration.  Services that were decommissioned stay recorded as
+// such.
+func (b *Books) markService(dat *agentData) {
+	if dat.config == nil || dat.config.IsService {
+		return
+	}
+	svc, err := b.eng.GetService(dat.Name)
+	dat.config.IsService = err == nil && svc.Id() == dat.Id
 }
 
 // TransNotify is used to collect information about matched, executed
@@ -98,9 +197,52 @@ func (b *Books) TransNotify(t *trans.Transaction) {
 	b.transIn <- t
 }
 
+// SaveState saves all agent and transaction information recorded so far.
+func (b *Books) SaveState(s *sim.State) {
+	b.do(func() {
+		s.Put("tId", b.tId)
+		s.Put("eId", b.eId)
+		s.Put("tranDat", b.tranDat)
+		b.markServices()
+		s.Put("agentDat", b.agentList())
+		s.Put("configs", b.configList())
+	})
+}
+
+// LoadState restores state saved by SaveState.
+func (b *Books) LoadState(s *sim.State) {
+	b.do(func() {
+		var agents []*agentData
+		var configs []*sim.AgentConfig
+		s.Get("tId", &b.tId)
+		s.Get("eId", &b.eId)
+		s.Get("tranDat", &b.tranDat)
+		s.Get("agentDat", &agents)
+		s.Get("configs", &configs)
+
+		b.agentDat = map[int]*agentData{}
+		for _, a := range agents {
+			b.agentDat[a.Id] = a
+		}
+		for _, cfg := range configs {
+			if a, ok := b.agentDat[cfg.Id]; ok {
+				a.config = cfg
+			}
+		}
+	})
+}
+
+// do runs f on the book-keeping goroutine and waits for it to return.
+func (b *Books) do(f func()) {
+	done := make(chan bool)
+	b.funcIn <- func() {
+		f()
+		done <- true
+	}
+	<-done
+}
+
 func (b *Books) regTrans(t *trans.Transaction) {
-	b.regAgent(t.Sup.(sim.Agent))
-	b.regAgent(t.Req.(sim.Agent))
 	for _, r := range t.Manifest {
 		tp := reflect.Indirect(reflect.ValueOf(r)).Type()
 		tdat := &transData{
@@ -118,42 +260,55 @@ func (b *Books) regTrans(t *trans.Transaction) {
 	b.tId++
 }
 
-func (b *Books) regAgent(a sim.Agent) {
-	if _, ok := b.agentDat[a.Id()]; ok {
-		return
-	}
-
-	tp := reflect.Indirect(reflect.ValueOf(a)).Type()
-	b.agentDat[a.Id()] = &agentData{
-		Id:   a.Id(),
-		Name: a.Name(),
-		Type: tp.PkgPath() + "." + tp.Name(),
-		Born: b.getTime(),
+func (b *Books) saveData() error {
+	e := b.eng
+	cfg := &sim.SimConfig{
+		Start:    e.Start,
+		Duration: e.Duration,
+		Step:     e.Step,
+		Seed:     e.Seed,
+		Agents:   b.configList(),
 	}
 
-	// this comes last to prevent infinite looping
-	if par := a.Parent(); par != nil {
-		b.agentDat[a.Id()].ParentId = par.Id()
-		b.regAgent(par)
+	err1 := dump(e.OutPath("agents.out"), b.agentList())
+	err2 := dump(e.OutPath("trans.out"), b.tranDat)
+	err3 := dump(e.OutPath("config.out"), cfg)
+	if err1 != nil {
+		return err1
+	} else if err2 != nil {
+		return err2
 	}
+	return err3
 }
 
-func (b *Books) saveData() error {
+// agentList returns the recorded agent information ordered by agent id.
+func (b *Books) agentList() []*agentData {
 	agents := []*agentData{}
 	for _, val := range b.agentDat {
 		agents = append(agents, val)
 	}
+	sort.Sort(byId(agents))
+	return agents
+}
 
-	err1 := dump("agents.out", agents)
-	err2 := dump("trans.out", b.tranDat)
-	if err1 != nil {
-		return err1
-	} else if err2 != nil {
-		return err2
+// configList returns the recorded effective configuration of every agent
+// ordered by agent id.
+func (b *Books) configList() []*sim.AgentConfig {
+	configs := []*sim.AgentConfig{}
+	for _, a := range b.agentList() {
+		if a.config != nil {
+			configs = append(configs, a.config)
+		}
 	}
-	return nil
+	return configs
 }
 
+type byId []*agentData
+
+func (s byId) Len() int           { return len(s) }
+func (s byId) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s byId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func (b *Books) getTime() time.Time {
 	if b.eng != nil {
 		return b.eng.Time()
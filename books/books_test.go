@@ -0,0 +1,76 @@
+package books
+
+import (
+	"encoding/json"
+	"github.com/rwcarlsen/goclus/sim"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentRecords(t *testing.T) {
+	dir := t.TempDir()
+	eng := &sim.Engine{Duration: 5 * time.Hour, Step: time.Hour, OutDir: dir}
+	eng.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	b := &Books{}
+	eng.RegisterAll(b)
+
+	a := &sim.Agenty{}
+	a.SetName("a")
+	par := &sim.Agenty{}
+	par.SetName("par")
+	kid := &sim.Agenty{}
+	kid.SetName("kid")
+	kid.SetParent(par)
+
+	svc := &sim.Agenty{}
+	svc.SetName("svc")
+
+	start := eng.Time()
+	// services are registered after being deployed
+	eng.RegisterAll(a)
+	assert.NoErr(t, eng.RegisterService(a)).Fatal()
+	eng.RegisterAll(svc)
+	assert.NoErr(t, eng.RegisterService(svc)).Fatal()
+	eng.DecommissionAt(start.Add(3*time.Hour), a)
+	// kid is deployed before its parent
+	eng.DeployAt(start.Add(time.Hour), kid)
+	eng.DeployAt(start.Add(2*time.Hour), par)
+	eng.Run()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "agents.out"))
+	assert.NoErr(t, err).Fatal()
+	var agents []*agentData
+	assert.NoErr(t, json.Unmarshal(data, &agents)).Fatal()
+	assert.Eq(t, len(agents), 5).Fatal()
+
+	byName := map[string]*agentData{}
+	for _, dat := range agents {
+		byName[dat.Name] = dat
+	}
+	assert.Eq(t, byName["a"].Born, start)
+	assert.Ne(t, byName["a"].Died, (*time.Time)(nil)).Fatal()
+	assert.Eq(t, *byName["a"].Died, start.Add(3*time.Hour))
+	assert.Eq(t, byName["kid"].Born, start.Add(time.Hour))
+	assert.Eq(t, byName["kid"].Died, (*time.Time)(nil))
+	assert.Eq(t, byName["kid"].ParentId, par.Id())
+	assert.Eq(t, byName["par"].Born, start.Add(2*time.Hour))
+	assert.Eq(t, byName["par"].ParentId, 0)
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "config.out"))
+	assert.NoErr(t, err).Fatal()
+	var cfg sim.SimConfig
+	assert.NoErr(t, json.Unmarshal(data, &cfg)).Fatal()
+	services := []string{}
+	for _, acfg := range cfg.Agents {
+		if acfg.IsService {
+			services = append(services, acfg.Name)
+		}
+	}
+	assert.Eq(t, strings.Join(services, " "), "a svc")
+}
@@ -1,6 +1,7 @@
 // Package comp contains types for manipulation of nuclear material compositions.
 package comp
 
+import "encoding/json"
 import "errors"
 import "math"
 import "github.com/rwcarlsen/goclus/isos"
@@ -57,6 +58,22 @@ func (c *Composition) Clone() *Composition {
 	return &Composition{comp: c.comp.Clone()}
 }
 
+// MarshalJSON encodes the composition's normalized isotope fractions.
+func (c *Composition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.comp)
+}
+
+// UnmarshalJSON decodes json created by MarshalJSON.  The decoded fractions
+// are used exactly as encoded (i.e. they are not renormalized).
+func (c *Composition) UnmarshalJSON(data []byte) error {
+	var m Map
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*c = Composition{comp: m}
+	return nil
+}
+
 // Partial returns a comp map from the composition containing only the
 // listed isotopes in ratios as they occur in the composition.  frac is the
 // total fraction of the composition that is composed of the listed
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rwcarlsen/goclus/batch"
+	"github.com/rwcarlsen/goclus/sim"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ensembleCmd runs many realizations of a simulation input file
+// concurrently and summarizes the results.
+//
+// Each realization's output is written to its own directory inside the
+// output directory (tagged with its seed and parameters in scenario.json)
+// along with an ensemble summary (summary.json).  Prototype configuration
+// values can be varied between realizations with one or more -vary flags:
+//
+//	-vary 'src.CreateRate=1:10'    uniform random value in [1, 10)
+//	-vary 'src.OutUnits=gal,kg'    random choice from a list
+//
+// If the input file declares a Sweep, n realizations of every sweep point
+// are run instead.
+func ensembleCmd(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	ef := addEngineFlags(fs)
+	n := fs.Int("n", 10, "number of realizations (per sweep point)")
+	workers := fs.Int("workers", 0, "number of concurrent realizations (default: number of CPUs)")
+	outDir := fs.String("out", "ensemble", "output directory")
+	seed := fs.Int64("seed", 1, "seed of the first realization")
+	var vary variations
+	fs.Var(&vary, "vary", "vary a prototype config value: 'proto.Field=min:max' or 'proto.Field=v1,v2,...'")
+	format := addFormatFlag(fs)
+	input, err := inputArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	scens, err := scenarios(input, *format, *n, *seed, vary)
+	if err != nil {
+		return err
+	}
+
+	r := &batch.Runner{
+		Input:     input,
+		Format:    *format,
+		OutDir:    *outDir,
+		Workers:   *workers,
+		Configure: ef.apply,
+	}
+	results := r.Run(scens)
+
+	s := batch.Summarize(results)
+	if err := batch.WriteSummary(*outDir, s); err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Err != "" {
+			fmt.Fprintf(fs.Output(), "%v: %v\n", res.Name, res.Err)
+		}
+	}
+	fmt.Fprintf(stdout, "%v runs, %v failed\n", s.Runs, s.Failed)
+	return nil
+}
+
+// scenarios returns the sweep scenarios declared in the input file or an
+// ensemble varied according to vary if there is no sweep.
+func scenarios(input, format string, n int, seed int64, vary variations) ([]*batch.Scenario, error) {
+	l := &sim.Loader{}
+	if err := decode(l, input, format); err != nil {
+		return nil, err
+	} else if len(l.Sweep) == 0 {
+		return batch.Ensemble(n, seed, vary), nil
+	} else if len(vary) > 0 {
+		return nil, errors.New("-vary cannot be used with an input file that declares a sweep")
+	}
+
+	points, err := l.SweepPoints()
+	if err != nil {
+		return nil, err
+	}
+	return batch.Sweep(points, n, seed), nil
+}
+
+// variations implements flag.Value for repeated -vary flags.
+type variations []batch.Variation
+
+func (v *variations) String() string {
+	return fmt.Sprint(*v)
+}
+
+func (v *variations) Set(s string) error {
+	eq := strings.Index(s, "=")
+	dot := strings.LastIndex(s[:max(eq, 0)], ".")
+	if eq < 0 || dot < 0 {
+		return fmt.Errorf("invalid variation '%v'", s)
+	}
+	va := batch.Variation{Proto: s[:dot], Field: s[dot+1 : eq]}
+
+	val := s[eq+1:]
+	if lo, hi, ok := strings.Cut(val, ":"); ok {
+		var err1, err2 error
+		va.Min, err1 = strconv.ParseFloat(lo, 64)
+		va.Max, err2 = strconv.ParseFloat(hi, 64)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid range '%v'", val)
+		}
+	} else {
+		for _, item := range strings.Split(val, ",") {
+			va.Values = append(va.Values, parseValue(item))
+		}
+	}
+	*v = append(*v, va)
+	return nil
+}
+
+// parseValue interprets s as json (e.g. numbers and booleans) if possible
+// and as a plain string otherwise.
+func parseValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
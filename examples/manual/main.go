@@ -6,14 +6,12 @@ import (
 	"github.com/rwcarlsen/goclus/books"
 	"github.com/rwcarlsen/goclus/rsrc"
 	"github.com/rwcarlsen/goclus/sim"
-	"time"
 )
 
 func main() {
-	var month time.Duration = 43829 * time.Minute
 	eng := &sim.Engine{
-		Duration: 36 * month,
-		Step:     month,
+		Duration: 3 * sim.Year,
+		Step:     sim.Month,
 	}
 	config(eng)
 
@@ -39,7 +37,7 @@ func config(eng *sim.Engine) {
 		OutUnits:      cheese,
 		OutSize:       5,
 		ConvertAmt:    5,
-		ConvertPeriod: 1,
+		ConvertPeriod: sim.Month,
 		ConvertOffset: 0,
 	}
 	null.SetName("null")
@@ -52,7 +50,7 @@ func config(eng *sim.Engine) {
 		OutUnits:      milk,
 		OutSize:       3,
 		ConvertAmt:    5,
-		ConvertPeriod: 1,
+		ConvertPeriod: sim.Month,
 		ConvertOffset: 0,
 	}
 	null2.SetName("null2")
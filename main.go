@@ -0,0 +1,315 @@
+// Command goclus runs and inspects simulations.
+//
+// Usage:
+//
+//	goclus <command> [flags] [args]
+//
+// The commands are:
+//
+//	run          run a simulation
+//	validate     check an input file for errors without running it
+//	list-agents  list the available agent types and document their configurable fields
+//	ensemble     run many realizations of a simulation concurrently
+//
+// Run "goclus <command> -h" for a command's flags.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	_ "github.com/rwcarlsen/goclus/agents/fac"
+	_ "github.com/rwcarlsen/goclus/agents/inst"
+	_ "github.com/rwcarlsen/goclus/agents/mkt"
+	_ "github.com/rwcarlsen/goclus/books"
+	"github.com/rwcarlsen/goclus/sim"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a goclus subcommand.  Its run function parses args with fs,
+// writes its results to stdout and its diagnostics to fs.Output().
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(fs *flag.FlagSet, args []string, stdout io.Writer) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"run", "<input>", "run a simulation", runCmd},
+		{"validate", "<input>", "check an input file for errors without running it", validateCmd},
+		{"list-agents", "", "list the available agent types and their configurable fields", listAgentsCmd},
+		{"ensemble", "<input>", "run many realizations of a simulation concurrently", ensembleCmd},
+	}
+}
+
+// errUsage is returned by commands invoked with invalid flags or the wrong
+// number of arguments after reporting the problem.
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command named by args[0] with the remaining args and returns
+// the exit status: 0 on success, 1 if the command fails and 2 if it is
+// invoked incorrectly.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 {
+		usage(stderr)
+		return 2
+	}
+
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		fs.Usage = func() {
+			fmt.Fprintf(stderr, "usage: goclus %v [flags] %v\n", c.name, c.args)
+			fs.PrintDefaults()
+		}
+		err := c.run(fs, args[1:], stdout)
+		switch {
+		case err == nil, errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		}
+		fmt.Fprintln(stderr, "goclus:", err)
+		return 1
+	}
+
+	usage(stderr)
+	return 2
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintln(out, "usage: goclus <command> [flags] [args]\n\ncommands:")
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %v\t%v\n", c.name, c.short)
+	}
+	w.Flush()
+}
+
+// engineFlags holds command line overrides of input file engine settings
+// shared by all commands that run simulations.
+type engineFlags struct {
+	fs          *flag.FlagSet
+	duration    durationFlag
+	logLevel    string
+	tickWorkers int
+}
+
+func addEngineFlags(fs *flag.FlagSet) *engineFlags {
+	ef := &engineFlags{fs: fs}
+	fs.Var(&ef.duration, "duration", "override the simulation duration (e.g. 50y, 18mo or 30d)")
+	fs.StringVar(&ef.logLevel, "log-level", "", "override the log level (debug, info, warn or error)")
+	fs.IntVar(&ef.tickWorkers, "tick-workers", 0, "override the number of goroutines running agent ticks concurrently")
+	return ef
+}
+
+// apply overrides the decoded engine settings with the flags that were set
+// on the command line.
+func (ef *engineFlags) apply(l *sim.Loader) error {
+	var err error
+	ef.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "duration":
+			l.Engine.Duration = time.Duration(ef.duration)
+		case "log-level":
+			err = l.Engine.LogLevel.UnmarshalText([]byte(ef.logLevel))
+		case "tick-workers":
+			l.Engine.TickWorkers = ef.tickWorkers
+		}
+	})
+	return err
+}
+
+// durationFlag is a flag.Value for durations written as in input files
+// (see sim.ParseDuration).
+type durationFlag time.Duration
+
+func (d *durationFlag) String() string { return time.Duration(*d).String() }
+
+func (d *durationFlag) Set(s string) error {
+	v, err := sim.ParseDuration(s)
+	*d = durationFlag(v)
+	return err
+}
+
+func addFormatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", "", "input file format: json, yaml or toml (default: from the file extension)")
+}
+
+// decode decodes the input file in format, or in the format implied by its
+// extension if format is empty.
+func decode(l *sim.Loader, input, format string) error {
+	if format == "" {
+		format = sim.FormatOf(input)
+	}
+	return l.DecodeFormat(input, format)
+}
+
+// parseFlags parses args with fs.  Invalid flags are reported by fs and
+// returned as errUsage.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return errUsage
+	}
+	return err
+}
+
+func inputArg(fs *flag.FlagSet, args []string) (string, error) {
+	if err := parseFlags(fs, args); err != nil {
+		return "", err
+	} else if fs.NArg() != 1 {
+		fs.Usage()
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+func runCmd(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	ef := addEngineFlags(fs)
+	outDir := fs.String("out", "", "output directory")
+	seed := fs.Int64("seed", 0, "override the engine seed")
+	resume := fs.String("resume", "", "resume the simulation from a checkpoint file")
+	trace := fs.String("trace", "", "record the path of every message and write the timelines to this file")
+	format := addFormatFlag(fs)
+	input, err := inputArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	l := &sim.Loader{}
+	if err := decode(l, input, *format); err != nil {
+		return err
+	} else if len(l.Sweep) > 0 {
+		return errors.New("input declares a parameter sweep; run it with 'goclus ensemble'")
+	} else if err := ef.apply(l); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			l.Engine.Seed = *seed
+		}
+	})
+	if *trace != "" {
+		l.Engine.TraceMsgs = true
+	}
+	if *outDir != "" {
+		l.Engine.OutDir = *outDir
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if *resume != "" {
+		err = l.Resume(*resume)
+	} else {
+		err = l.Build()
+	}
+	if err != nil {
+		return err
+	}
+	l.Engine.Run()
+	if *trace != "" {
+		return l.Engine.WriteMsgTraces(l.Engine.OutPath(*trace))
+	}
+	return nil
+}
+
+func validateCmd(fs *flag.FlagSet, args []string, stdout io.Writer) (err error) {
+	format := addFormatFlag(fs)
+	input, err := inputArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%v", v)
+		}
+	}()
+	l := &sim.Loader{}
+	if err := decode(l, input, *format); err != nil {
+		return err
+	}
+	var errs sim.InputErrors
+	if errors.As(l.Validate(), &errs) {
+		for _, e := range errs {
+			fmt.Fprintf(stdout, "%v: %v\n", input, e)
+		}
+		return fmt.Errorf("%v problem(s) found in %v", len(errs), input)
+	}
+
+	l.Engine.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	if err := l.Build(); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, input+": ok")
+	return nil
+}
+
+func listAgentsCmd(fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	} else if fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	l := &sim.Loader{}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	for _, path := range l.AgentTypes() {
+		if aliases := l.Aliases(path); len(aliases) > 0 {
+			fmt.Fprintf(w, "%v (%v)\n", path, strings.Join(aliases, ", "))
+		} else {
+			fmt.Fprintln(w, path)
+		}
+		schema, err := l.Schema(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range schema {
+			fmt.Fprintf(w, "  %v\t%v\t%v\n", f.Name, f.Type, fieldDoc(f))
+		}
+	}
+	return w.Flush()
+}
+
+// fieldDoc returns the description of a configuration field followed by
+// its constraints.
+func fieldDoc(f *sim.FieldSchema) string {
+	var details []string
+	if f.Required {
+		details = append(details, "required")
+	}
+	if f.Units != "" {
+		details = append(details, "units: "+f.Units)
+	}
+	if r := f.Range(); r != "" {
+		details = append(details, "range: "+r)
+	}
+	if f.Default != "" {
+		details = append(details, "default: "+f.Default)
+	}
+
+	doc := f.Desc
+	if len(details) > 0 {
+		doc += " (" + strings.Join(details, ", ") + ")"
+	}
+	return strings.TrimSpace(doc)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	out := t.TempDir()
+	tests := []struct {
+		args   []string
+		status int
+		stdout string // a substring of the expected output
+		stderr string // a substring of the expected diagnostics
+	}{
+		{nil, 2, "", "commands:"},
+		{[]string{"bogus"}, 2, "", "commands:"},
+		{[]string{"run"}, 2, "", "usage: goclus run"},
+		{[]string{"run", "a.json", "b.json"}, 2, "", "usage: goclus run"},
+		{[]string{"run", "-bogus", "input.json"}, 2, "", "flag provided but not defined: -bogus"},
+		{[]string{"run", "-duration", "soon", "input.json"}, 2, "", "invalid value"},
+		{[]string{"run", "-h"}, 0, "", "-tick-workers"},
+		{[]string{"run", "-log-level", "loud", "input.json"}, 1, "", "goclus: "},
+		{[]string{"run", "missing.json"}, 1, "", "goclus: "},
+		{[]string{"run", "-duration", "2mo", "-log-level", "error", "-out", out, "input.json"}, 0, "", ""},
+		{[]string{"validate"}, 2, "", "usage: goclus validate"},
+		{[]string{"validate", "missing.json"}, 1, "", "goclus: "},
+		{[]string{"validate", "-format", "xml", "input.json"}, 1, "", "goclus: "},
+		{[]string{"validate", "input.yaml"}, 0, "input.yaml: ok", ""},
+		{[]string{"list-agents", "extra"}, 2, "", "usage: goclus list-agents"},
+		{[]string{"list-agents"}, 0, "github.com/rwcarlsen/goclus/agents/mkt.Mkt", ""},
+		{[]string{"ensemble", "-vary", "bad", "input.json"}, 2, "", "invalid variation 'bad'"},
+		{[]string{"ensemble", "-n", "2", "-duration", "2mo", "-log-level", "error", "-out", filepath.Join(out, "ens"), "input.json"}, 0, "2 runs, 0 failed", ""},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(test.args, &stdout, &stderr)
+		args := strings.Join(test.args, " ")
+		assert.Eq(t, args+" -> "+fmt.Sprint(status), args+" -> "+fmt.Sprint(test.status))
+		if !strings.Contains(stdout.String(), test.stdout) {
+			t.Errorf("%v: output %q lacks %q", args, stdout.String(), test.stdout)
+		}
+		if !strings.Contains(stderr.String(), test.stderr) {
+			t.Errorf("%v: diagnostics %q lack %q", args, stderr.String(), test.stderr)
+		}
+	}
+
+	// the run wrote its output
+	_, err := os.Stat(filepath.Join(out, "agents.out"))
+	assert.NoErr(t, err)
+}
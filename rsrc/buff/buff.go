@@ -41,6 +41,15 @@ func (b *Buffer) Count() int {
 	return len(b.res)
 }
 
+// Resources returns the resource objects held in the buffer in the order
+// they were pushed.  The returned slice is a copy, but the resource objects
+// are not.
+func (b *Buffer) Resources() []rsrc.Resource {
+	rs := make([]rsrc.Resource, len(b.res))
+	copy(rs, b.res)
+	return rs
+}
+
 // Qty returns the total resource quantity of constituent resource objects in the buffer.
 func (b *Buffer) Qty() float64 {
 	var tot float64
@@ -0,0 +1,54 @@
+package rsrc
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var types = map[string]func() Resource{}
+
+func init() {
+	RegisterType("Generic", func() Resource { return &generic{} })
+}
+
+// RegisterType makes resources of the given type (as returned by the
+// Resource Type method) decodable by Unmarshal.  newRes must return a new,
+// empty resource whose json decoding restores the state of an encoded
+// resource of that type.
+func RegisterType(name string, newRes func() Resource) {
+	types[name] = newRes
+}
+
+// encoded is the self-describing json representation of a resource.
+type encoded struct {
+	Type string
+	Data json.RawMessage
+}
+
+// Marshal returns the json encoding of r along with its type.
+func Marshal(r Resource) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded{Type: r.Type(), Data: data})
+}
+
+// Unmarshal decodes a resource encoded by Marshal.  An error is returned if
+// the encoded resource's type has not been registered via RegisterType.
+func Unmarshal(data []byte) (Resource, error) {
+	var enc encoded
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return nil, err
+	}
+
+	newRes, ok := types[enc.Type]
+	if !ok {
+		return nil, errors.New("rsrc: unregistered resource type '" + enc.Type + "'")
+	}
+	r := newRes()
+	if err := json.Unmarshal(enc.Data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -1,5 +1,7 @@
 package rsrc
 
+import "encoding/json"
+
 type generic struct {
 	units string
 	qty   float64
@@ -40,3 +42,23 @@ func (g *generic) Clone() Resource {
 	clone := *g
 	return &clone
 }
+
+type genericData struct {
+	Units string
+	Qty   float64
+}
+
+// MarshalJSON encodes the resource's units and quantity.
+func (g *generic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(genericData{Units: g.units, Qty: g.qty})
+}
+
+// UnmarshalJSON decodes json created by MarshalJSON.
+func (g *generic) UnmarshalJSON(data []byte) error {
+	var dat genericData
+	if err := json.Unmarshal(data, &dat); err != nil {
+		return err
+	}
+	g.units, g.qty = dat.Units, dat.Qty
+	return nil
+}
@@ -2,6 +2,7 @@
 package mat
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/rwcarlsen/goclus/comp"
 	"github.com/rwcarlsen/goclus/rsrc"
@@ -9,6 +10,10 @@ import (
 
 const Type = "Material"
 
+func init() {
+	rsrc.RegisterType(Type, func() rsrc.Resource { return &Material{} })
+}
+
 // Material is a resource for tracking, and manipulating nuclear materials.
 type Material struct {
 	// Comp represents the nuclear composition of the material.
@@ -98,3 +103,23 @@ func (m *Material) Absorb(other *Material) {
 	m.qty += other.qty
 	other.qty = 0
 }
+
+type matData struct {
+	Comp *comp.Composition
+	Qty  float64
+}
+
+// MarshalJSON encodes the material's quantity and composition.
+func (m *Material) MarshalJSON() ([]byte, error) {
+	return json.Marshal(matData{Comp: m.Comp, Qty: m.qty})
+}
+
+// UnmarshalJSON decodes json created by MarshalJSON.
+func (m *Material) UnmarshalJSON(data []byte) error {
+	var dat matData
+	if err := json.Unmarshal(data, &dat); err != nil {
+		return err
+	}
+	m.Comp, m.qty = dat.Comp, dat.Qty
+	return nil
+}
@@ -2,6 +2,8 @@ package mat
 
 import (
 	"github.com/rwcarlsen/goclus/comp"
+	"github.com/rwcarlsen/goclus/isos"
+	"github.com/rwcarlsen/goclus/rsrc"
 	"github.com/rwcarlsen/goclus/util/assert"
 	"testing"
 )
@@ -116,3 +118,21 @@ func TestAbsorb(t *testing.T) {
 	assert.Eq(t, m3.Qty(), zero)
 	assert.Ne(t, m1.Comp, cmp)
 }
+
+func TestMarshal(t *testing.T) {
+	m := mat3()
+	data, err := rsrc.Marshal(m)
+	assert.NoErr(t, err).Fatal()
+
+	r, err := rsrc.Unmarshal(data)
+	assert.NoErr(t, err).Fatal()
+	m2, ok := r.(*Material)
+	assert.Eq(t, ok, true).Fatal()
+	assert.Eq(t, m2.Qty(), m.Qty())
+
+	for _, iso := range []isos.Iso{922380, 942390} {
+		_, frac := m2.Comp.Partial(iso)
+		_, expected := m.Comp.Partial(iso)
+		assert.Eq(t, frac, expected)
+	}
+}
@@ -0,0 +1,137 @@
+package sim
+
+import (
+	"reflect"
+)
+
+type addrKind int
+
+const (
+	allAddr addrKind = iota
+	nameAddr
+	typeAddr
+	subtreeAddr
+)
+
+// Addr addresses a message to a group of agents (see NewMsgTo).
+type Addr struct {
+	kind addrKind
+	name string
+	root Agent
+}
+
+// ToAll addresses every deployed agent.
+func ToAll() Addr {
+	return Addr{kind: allAddr}
+}
+
+// ToName addresses all deployed agents named name.
+func ToName(name string) Addr {
+	return Addr{kind: nameAddr, name: name}
+}
+
+// ToType addresses all deployed agents of the agent type with the given
+// import path or registered alias (see Register), e.g. "fac".
+func ToType(typ string) Addr {
+	return Addr{kind: typeAddr, name: typ}
+}
+
+// ToSubtree addresses all deployed descendants of root (i.e. its children,
+// their children, etc.), but not root itself.
+func ToSubtree(root Agent) Addr {
+	return Addr{kind: subtreeAddr, root: root}
+}
+
+// Lookup returns the deployed agents addressed by addr in id order.
+func (e *Engine) Lookup(addr Addr) []Agent {
+	typ := addr.name
+	if addr.kind == typeAddr {
+		if e.Load != nil {
+			_, typ, _ = e.Load.agentType(addr.name)
+		} else {
+			_, typ, _ = registry.lookup(addr.name)
+		}
+	}
+
+	agents := []Agent{}
+	for _, id := range e.agentIds() {
+		a := e.agents[id]
+		switch addr.kind {
+		case nameAddr:
+			if a.Name() != addr.name {
+				continue
+			}
+		case typeAddr:
+			if typePath(a) != typ {
+				continue
+			}
+		case subtreeAddr:
+			if !descends(a, addr.root) {
+				continue
+			}
+		}
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+// descends returns true if a is a descendant of root.
+func descends(a, root Agent) bool {
+	for p := a.Parent(); p != nil; p = p.Parent() {
+		if p == root {
+			return true
+		}
+	}
+	return false
+}
+
+// typePath returns the import path of a's agent type, e.g.
+// "github.com/rwcarlsen/goclus/agents/fac.Fac".
+func typePath(a Agent) string {
+	t := reflect.Indirect(reflect.ValueOf(a)).Type()
+	return t.PkgPath() + "." + t.Name()
+}
+
+// NewMsgTo creates a new message addressed to the group of agents addr.
+// When the message is sent (via SendOn), the sender's engine fans out a
+// clone of it to every addressed agent except the sender (in id order) as
+// if each had been created with NewMsg for that agent; the original message
+// itself goes nowhere.  The clones are returned by Clones after the
+// message is sent.
+func NewMsgTo(sender Agent, addr Addr) *Message {
+	eng := engineOf(sender)
+	if eng == nil {
+		panic("msg: addressed message sender must be registered with an engine")
+	}
+	return &Message{
+		Dir:       UpMsg,
+		eng:       eng,
+		sender:    sender,
+		Owner:     sender,
+		pathStack: []Agent{sender},
+		to:        &addr,
+	}
+}
+
+// Clones returns the clones an addressed message (see NewMsgTo) was fanned
+// out as or nil if it hasn't been sent.
+func (m *Message) Clones() []*Message {
+	return m.clones
+}
+
+// fanOut sends a clone of addressed message m to each addressed agent.
+func (e *Engine) fanOut(m *Message) {
+	e.assignId(m)
+	m.clones = []*Message{}
+	for _, a := range e.Lookup(*m.to) {
+		if a == m.sender {
+			continue
+		}
+		c := m.Clone()
+		c.to, c.clones, c.receiver = nil, nil, a
+		m.clones = append(m.clones, c)
+	}
+	for _, c := range m.clones {
+		c.SendOn()
+	}
+}
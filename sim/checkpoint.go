@@ -0,0 +1,564 @@
+package sim
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rwcarlsen/goclus/rsrc"
+	"github.com/rwcarlsen/goclus/trans"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// Checkpointer is implemented by agents that hold internal simulation state
+// (beyond their exported, json-encodable fields) which must be saved in
+// order for a checkpointed simulation to be resumed with identical results.
+//
+// LoadState is called on a restored agent after it and all other
+// checkpointed agents have been re-registered with the engine (i.e. after
+// its Start method has been called).  Scheduled events are not saved in
+// checkpoints - agents that schedule events must save them with
+// State.PutEvent and re-schedule them in LoadState with State.Event.
+type Checkpointer interface {
+	SaveState(*State)
+	LoadState(*State)
+}
+
+// State holds the checkpointed internal state of a single agent as a set of
+// named json-encoded values.  Encoding and decoding errors are sticky: after
+// the first error, all further operations do nothing and the error is
+// reported by the engine.
+type State struct {
+	eng  *Engine
+	vals map[string]json.RawMessage
+	err  error
+	// retired holds decommissioned agents referenced by saved messages
+	retired map[int]Agent
+}
+
+// Err returns the first error encountered saving or loading the state.
+func (s *State) Err() error {
+	return s.err
+}
+
+// Fail records err as the state's error if no other error has occurred.
+func (s *State) Fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Put saves the json encoding of v under key.
+func (s *State) Put(key string, v interface{}) {
+	if s.err != nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.Fail(fmt.Errorf("sim: cannot save state '%v': %v", key, err))
+		return
+	}
+	s.vals[key] = data
+}
+
+// Get decodes the value saved under key into v.
+func (s *State) Get(key string, v interface{}) {
+	if s.err != nil {
+		return
+	}
+	data, ok := s.vals[key]
+	if !ok {
+		s.Fail(errors.New("sim: no saved state '" + key + "'"))
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		s.Fail(fmt.Errorf("sim: cannot load state '%v': %v", key, err))
+	}
+}
+
+// PutResources saves rs under key.  All resources must be of types
+// registered via rsrc.RegisterType.
+func (s *State) PutResources(key string, rs []rsrc.Resource) {
+	s.Put(key, s.encodeResources(rs))
+}
+
+// Resources returns the resources saved under key.
+func (s *State) Resources(key string) []rsrc.Resource {
+	var enc []json.RawMessage
+	s.Get(key, &enc)
+	return s.decodeResources(enc)
+}
+
+// PutMsgs saves msgs under key.  Agents referenced by the messages are
+// saved by id.  Message payloads are not saved.  Messages referenced by
+// more than one agent are restored as independent copies.
+func (s *State) PutMsgs(key string, msgs []*Message) {
+	enc := make([]*msgState, len(msgs))
+	for i, m := range msgs {
+		enc[i] = s.encodeMsg(m)
+	}
+	s.Put(key, enc)
+}
+
+// Msgs returns the messages saved under key.
+func (s *State) Msgs(key string) MsgGroup {
+	var enc []*msgState
+	s.Get(key, &enc)
+	msgs := MsgGroup{}
+	for _, ms := range enc {
+		msgs = append(msgs, s.decodeMsg(ms))
+	}
+	return msgs
+}
+
+// eventState is the checkpoint representation of a scheduled event.
+type eventState struct {
+	Time time.Time
+	Seq  int
+}
+
+// PutEvent saves the time and scheduling order of ev under key.  A nil,
+// canceled or already fired event is saved as no event.
+func (s *State) PutEvent(key string, ev *Event) {
+	var es *eventState
+	if ev != nil && !ev.canceled && !ev.Time.Before(s.eng.Time()) {
+		es = &eventState{Time: ev.Time, Seq: ev.seq}
+	}
+	s.Put(key, es)
+}
+
+// Event schedules fn for the time of the event saved under key and returns
+// the new event (or nil if no event was saved).  It fires in the same order
+// relative to other events at that time as the saved event would have.
+func (s *State) Event(key string, fn func()) *Event {
+	var es *eventState
+	s.Get(key, &es)
+	if es == nil {
+		return nil
+	}
+	return s.eng.scheduleSeq(es.Time, fn, es.Seq)
+}
+
+// msgState is the checkpoint representation of a message.  Agents are
+// stored by id with zero representing nil.
+type msgState struct {
+	Id        int `json:",omitempty"`
+	Dir       msgDir
+	Trans     *transState `json:",omitempty"`
+	Sender    int
+	Receiver  int
+	Owner     int
+	PrevOwner int
+	Path      []int
+	HasDest   bool
+	Rejection string `json:",omitempty"`
+}
+
+type transState struct {
+	Type     trans.TransType
+	Res      json.RawMessage
+	Sup      int
+	Req      int
+	Manifest []json.RawMessage
+}
+
+func (s *State) encodeMsg(m *Message) *msgState {
+	ms := &msgState{
+		Id:        m.id,
+		Dir:       m.Dir,
+		Sender:    s.ref(m.sender),
+		Receiver:  s.ref(m.receiver),
+		Owner:     s.ref(m.Owner),
+		PrevOwner: s.ref(m.PrevOwner),
+		HasDest:   m.hasDest,
+		Rejection: m.rejection,
+	}
+	for _, a := range m.pathStack {
+		ms.Path = append(ms.Path, s.ref(a))
+	}
+
+	if t := m.Trans; t != nil {
+		ts := &transState{Type: t.Type(), Manifest: s.encodeResources(t.Manifest)}
+		if t.Resource() != nil {
+			ts.Res = s.encodeResources([]rsrc.Resource{t.Resource()})[0]
+		}
+		if a, ok := t.Sup.(Agent); ok {
+			ts.Sup = s.ref(a)
+		}
+		if a, ok := t.Req.(Agent); ok {
+			ts.Req = s.ref(a)
+		}
+		ms.Trans = ts
+	}
+	return ms
+}
+
+func (s *State) decodeMsg(ms *msgState) *Message {
+	m := &Message{
+		id:        ms.Id,
+		Dir:       ms.Dir,
+		eng:       s.eng,
+		sender:    s.agent(ms.Sender),
+		receiver:  s.agent(ms.Receiver),
+		Owner:     s.agent(ms.Owner),
+		PrevOwner: s.agent(ms.PrevOwner),
+		hasDest:   ms.HasDest,
+		rejection: ms.Rejection,
+	}
+	for _, id := range ms.Path {
+		m.pathStack = append(m.pathStack, s.agent(id))
+	}
+
+	if ts := ms.Trans; ts != nil {
+		var t *trans.Transaction
+		if ts.Type == trans.Offer {
+			t = trans.NewOffer(nil)
+		} else {
+			t = trans.NewRequest(nil)
+		}
+		if ts.Res != nil {
+			t.SetResource(s.decodeResources([]json.RawMessage{ts.Res})[0])
+		}
+		if sup, ok := s.agent(ts.Sup).(trans.Supplier); ok {
+			t.Sup = sup
+		}
+		if req, ok := s.agent(ts.Req).(trans.Requester); ok {
+			t.Req = req
+		}
+		t.Manifest = s.decodeResources(ts.Manifest)
+		t.SetNotifier(&s.eng.transLis)
+		m.Trans = t
+	}
+	return m
+}
+
+func (s *State) encodeResources(rs []rsrc.Resource) []json.RawMessage {
+	enc := []json.RawMessage{}
+	for _, r := range rs {
+		data, err := rsrc.Marshal(r)
+		if err != nil {
+			s.Fail(err)
+			return nil
+		}
+		enc = append(enc, data)
+	}
+	return enc
+}
+
+func (s *State) decodeResources(enc []json.RawMessage) []rsrc.Resource {
+	rs := []rsrc.Resource{}
+	for _, data := range enc {
+		r, err := rsrc.Unmarshal(data)
+		if err != nil {
+			s.Fail(err)
+			return nil
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// ref returns the id of a for saving, noting a if it was decommissioned so
+// that it is saved with the checkpoint.
+func (s *State) ref(a Agent) int {
+	if a != nil && !s.eng.deployed(a) {
+		s.retired[a.Id()] = a
+	}
+	return agentId(a)
+}
+
+// agent returns the deployed (or saved decommissioned) agent with the given
+// id or nil if id is zero.
+func (s *State) agent(id int) Agent {
+	if id == 0 {
+		return nil
+	}
+	a, ok := s.eng.agents[id]
+	if !ok {
+		a, ok = s.retired[id]
+	}
+	if !ok {
+		s.Fail(fmt.Errorf("sim: saved state references unknown agent id %v", id))
+		return nil
+	}
+	return a
+}
+
+func agentId(a Agent) int {
+	if a == nil {
+		return 0
+	}
+	return a.Id()
+}
+
+// checkpoint is the file representation of a saved simulation.
+type checkpoint struct {
+	Time      time.Time
+	NextId    int
+	NextMsgId int `json:",omitempty"`
+	EventSeq  int
+	Agents    []*agentState
+	// Retired are decommissioned agents that are parents of saved agents
+	// or are referenced by saved messages.  They are restored but not
+	// deployed.
+	Retired []*agentState `json:",omitempty"`
+	// Pending holds the scheduling order of the deployment ("deploy NAME")
+	// and decommissioning ("retire NAME") events of input agents not yet
+	// deployed.
+	Pending map[string]int `json:",omitempty"`
+}
+
+type agentState struct {
+	Id        int
+	Name      string
+	ProtoId   string
+	ParentId  int
+	IsService bool
+	Retire    *time.Time `json:",omitempty"`
+	RetireSeq int        `json:",omitempty"`
+	Rand      []byte     `json:",omitempty"`
+	Config    json.RawMessage
+	State     map[string]json.RawMessage `json:",omitempty"`
+}
+
+// Checkpoint writes the full simulation state to the file fname.  Only
+// agents created from loader prototypes can be checkpointed.  Agents with
+// internal state must implement Checkpointer.
+func (e *Engine) Checkpoint(fname string) error {
+	if e.Load == nil {
+		return errors.New("sim: cannot checkpoint an engine without a loader")
+	} else if e.inFlight > 0 {
+		return errors.New("sim: cannot checkpoint with undelivered messages in flight")
+	}
+
+	ck := &checkpoint{Time: e.Time(), NextId: e.nextId, NextMsgId: e.nextMsgId, EventSeq: e.eventSeq}
+	retired := map[int]Agent{}
+	for _, id := range e.agentIds() {
+		a := e.agents[id]
+		st, err := e.agentState(a)
+		if err != nil {
+			return err
+		}
+		st.IsService = e.services[a.Name()] == a
+		if ev := e.retire[a]; ev != nil && !ev.canceled {
+			t := ev.Time
+			st.Retire, st.RetireSeq = &t, ev.seq
+		}
+		if rng, ok := e.rngs[id]; ok {
+			if st.Rand, err = rng.src.MarshalBinary(); err != nil {
+				return err
+			}
+		}
+		if c, ok := a.(Checkpointer); ok {
+			s := &State{eng: e, vals: map[string]json.RawMessage{}, retired: retired}
+			c.SaveState(s)
+			if s.err != nil {
+				return s.err
+			}
+			st.State = s.vals
+		}
+		ck.Agents = append(ck.Agents, st)
+		if p := a.Parent(); p != nil && !e.deployed(p) {
+			retired[p.Id()] = p
+		}
+	}
+
+	// save decommissioned agents (and their decommissioned ancestors) that
+	// are still referenced
+	saved := map[int]bool{}
+	for len(saved) < len(retired) {
+		ids := []int{}
+		for id := range retired {
+			if !saved[id] {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			a := retired[id]
+			st, err := e.agentState(a)
+			if err != nil {
+				return err
+			}
+			ck.Retired = append(ck.Retired, st)
+			saved[id] = true
+			if p := a.Parent(); p != nil && !e.deployed(p) {
+				retired[p.Id()] = p
+			}
+		}
+	}
+	sort.Slice(ck.Retired, func(i, j int) bool { return ck.Retired[i].Id < ck.Retired[j].Id })
+
+	for name, d := range e.Load.deploys {
+		if d.ev.canceled || e.deployed(d.a) || d.ev.Time.Before(ck.Time) {
+			continue
+		}
+		if ck.Pending == nil {
+			ck.Pending = map[string]int{}
+		}
+		ck.Pending["deploy "+name] = d.ev.seq
+		if ev := e.retire[d.a]; ev != nil {
+			ck.Pending["retire "+name] = ev.seq
+		}
+	}
+
+	data, err := json.Marshal(ck)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash mid-write doesn't clobber
+	// the previous checkpoint
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// agentState returns the checkpoint representation of a without its
+// internal state.
+func (e *Engine) agentState(a Agent) (*agentState, error) {
+	protoId, ok := e.Load.protoOf[a]
+	if !ok {
+		return nil, errors.New("sim: cannot checkpoint agent '" + a.Name() + "' not created from a prototype")
+	}
+	config, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("sim: cannot checkpoint agent '%v': %v", a.Name(), err)
+	}
+	return &agentState{
+		Id:       a.Id(),
+		Name:     a.Name(),
+		ProtoId:  protoId,
+		ParentId: agentId(a.Parent()),
+		Config:   config,
+	}, nil
+}
+
+// Resume restores the simulation state saved in the checkpoint file ckpt.
+// It is called after Decode in place of Build; the decoded input must be
+// the input the checkpointed simulation was built from.  Agents from the
+// input that were not yet deployed at the time of the checkpoint are
+// scheduled for deployment as usual.  Running the engine continues the
+// simulation from the checkpoint time.
+func (l *Loader) Resume(ckpt string) error {
+	if err := l.Validate(); err != nil {
+		return err
+	} else if err := l.buildProtos(); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(ckpt)
+	if err != nil {
+		return err
+	}
+	ck := &checkpoint{}
+	if err := json.Unmarshal(data, ck); err != nil {
+		return prettyParseError(string(data), err)
+	}
+
+	e := l.Engine
+	e.tm, e.begun = ck.Time, true
+	e.eventSeq = ck.EventSeq
+	e.Load = l
+
+	// recreate agents
+	agents := map[int]Agent{}
+	byName := map[string]Agent{}
+	all := append(append([]*agentState{}, ck.Agents...), ck.Retired...)
+	for _, st := range all {
+		if _, ok := l.protos[st.ProtoId]; !ok {
+			return errors.New("loader: checkpoint references unknown prototype '" + st.ProtoId + "'")
+		}
+		a := l.NewAgentFromProto(st.ProtoId, nil)
+		if err := json.Unmarshal(st.Config, a); err != nil {
+			return prettyMarshalErr(st.ProtoId, st.Config, err)
+		}
+		a.SetName(st.Name)
+		agents[st.Id] = a
+		byName[st.Name] = a
+	}
+	for _, st := range all {
+		if par, ok := agents[st.ParentId]; ok {
+			agents[st.Id].SetParent(par)
+		}
+	}
+
+	// re-register agents with their original ids
+	for _, st := range ck.Agents {
+		a := agents[st.Id]
+		e.nextId = st.Id - 1
+		if st.IsService {
+			if err := e.RegisterService(a); err != nil {
+				return err
+			}
+		}
+		e.RegisterAll(a)
+		if st.Retire != nil {
+			e.decommissionAt(*st.Retire, a, st.RetireSeq)
+		}
+	}
+	e.nextId = ck.NextId
+	e.nextMsgId = ck.NextMsgId
+
+	for _, st := range ck.Agents {
+		if st.Rand == nil {
+			continue
+		}
+		e.Rand(agents[st.Id])
+		if err := e.rngs[st.Id].src.UnmarshalBinary(st.Rand); err != nil {
+			return err
+		}
+	}
+
+	retired := map[int]Agent{}
+	for _, st := range ck.Retired {
+		retired[st.Id] = agents[st.Id]
+		retired[st.Id].SetId(st.Id)
+	}
+	for _, st := range ck.Agents {
+		if c, ok := agents[st.Id].(Checkpointer); ok {
+			s := &State{eng: e, vals: st.State, retired: retired}
+			c.LoadState(s)
+			if s.err != nil {
+				return s.err
+			}
+		}
+	}
+
+	// schedule input agents not yet deployed
+	start := e.Start
+	pending := []*AgentInfo{}
+	for _, info := range l.expandAgents(nil) {
+		if info.Start > 0 && !start.Add(info.Start).Before(e.tm) {
+			pending = append(pending, info)
+		}
+	}
+	l.scheduleAgents(pending, byName)
+
+	// restore the order of pending events scheduled at identical times
+	for name, d := range l.deploys {
+		if seq, ok := ck.Pending["deploy "+name]; ok {
+			d.ev.seq = seq
+		}
+		if seq, ok := ck.Pending["retire "+name]; ok && e.retire[d.a] != nil {
+			e.retire[d.a].seq = seq
+		}
+	}
+	heap.Init(&e.events)
+	return nil
+}
+
+// agentIds returns the ids of all deployed agents in increasing order.
+func (e *Engine) agentIds() []int {
+	ids := []int{}
+	for id := range e.agents {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,178 @@
+package sim
+
+import (
+	"fmt"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drawResults holds the draws of every drawer by name at the time it ended.
+var drawResults map[string]string
+
+// drawer is a test agent that draws from its random number stream every
+// tick and keeps the draws as internal (checkpointed) state.
+type drawer struct {
+	Agenty
+	Scale uint64
+	draws []uint64
+	eng   *Engine
+}
+
+func (d *drawer) Start(e *Engine) { d.eng = e }
+func (d *drawer) Tick()           { d.draws = append(d.draws, d.eng.Rand(d).Uint64()%1000*d.Scale) }
+func (d *drawer) End(e *Engine)   { drawResults[d.Name()] = fmt.Sprint(e.SinceStart(), d.draws) }
+
+func (d *drawer) SaveState(s *State) { s.Put("draws", d.draws) }
+func (d *drawer) LoadState(s *State) { s.Get("draws", &d.draws) }
+
+func TestCheckpointResume(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "ck.json")
+	newLoader := func() *Loader {
+		l := &Loader{
+			Engine: &Engine{
+				Duration:        10 * time.Hour,
+				Step:            time.Hour,
+				Seed:            7,
+				CheckpointEvery: 5 * time.Hour,
+				CheckpointFile:  fname,
+			},
+			Prototypes: map[string]*ProtoInfo{
+				"d": {ImportPath: "github.com/rwcarlsen/goclus/sim.drawer", Config: map[string]interface{}{"Scale": 3}},
+			},
+			Agents: []*AgentInfo{
+				// checkpointed at 5h: a's decommissioning and c's deployment
+				// are still pending
+				{Name: "a", ProtoId: "d", Lifetime: 6 * time.Hour},
+				{Name: "b", ProtoId: "d"},
+				{Name: "c", ProtoId: "d", Start: 7 * time.Hour},
+			},
+		}
+		l.Register(drawer{})
+		l.Engine.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+		return l
+	}
+
+	drawResults = map[string]string{}
+	l := newLoader()
+	assert.NoErr(t, l.Build()).Fatal()
+	l.Engine.Run()
+	full := drawResults
+
+	drawResults = map[string]string{}
+	l = newLoader()
+	assert.NoErr(t, l.Resume(fname)).Fatal()
+	assert.Eq(t, l.Engine.SinceStart(), 5*time.Hour)
+	l.Engine.Run()
+
+	// a draws once in each of its 6 hours
+	assert.Eq(t, strings.HasPrefix(full["a"], "6h0m0s ["), true)
+	assert.Eq(t, len(strings.Fields(full["a"])), 7)
+	assert.Eq(t, len(full), 3)
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Eq(t, drawResults[name], full[name])
+	}
+}
+
+// eventLog records the events fired by keepers.
+var eventLog []string
+
+// keeper is a test agent that schedules an event at 7h in its Start and
+// holds a message from its parent.
+type keeper struct {
+	Agenty
+	ev   *Event
+	msgs []*Message
+	eng  *Engine
+}
+
+func (k *keeper) Start(e *Engine) {
+	k.eng = e
+	k.ev = e.Schedule(e.Start.Add(7*time.Hour), k.fire)
+	if k.Parent() != nil {
+		k.msgs = append(k.msgs, NewMsg(k.Parent(), k))
+	}
+}
+
+func (k *keeper) fire() {
+	s := fmt.Sprint(k.eng.SinceStart(), " ", k.Name())
+	if p := k.Parent(); p != nil {
+		s += " parent=" + p.Name() + " sender=" + k.msgs[0].Sender().Name()
+	}
+	eventLog = append(eventLog, s)
+}
+
+func (k *keeper) End(e *Engine) {
+	k.ev.Cancel()
+	eventLog = append(eventLog, fmt.Sprint(e.SinceStart(), " ", k.Name(), " ended"))
+}
+
+func (k *keeper) SaveState(s *State) {
+	s.PutEvent("ev", k.ev)
+	s.PutMsgs("msgs", k.msgs)
+}
+
+func (k *keeper) LoadState(s *State) {
+	k.ev.Cancel()
+	k.ev = s.Event("ev", k.fire)
+	k.msgs = s.Msgs("msgs")
+}
+
+func TestCheckpointEventOrder(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "ck.json")
+	newLoader := func() *Loader {
+		l := &Loader{
+			Engine: &Engine{
+				Duration:        9 * time.Hour,
+				Step:            time.Hour,
+				CheckpointEvery: 5 * time.Hour,
+				CheckpointFile:  fname,
+			},
+			Prototypes: map[string]*ProtoInfo{
+				"k": {ImportPath: "github.com/rwcarlsen/goclus/sim.keeper"},
+			},
+			Agents: []*AgentInfo{
+				// c's event, c's decommissioning, d's deployment and the
+				// events of kid and a are all due at 7h
+				{Name: "c", ProtoId: "k", Lifetime: 7 * time.Hour},
+				{Name: "d", ProtoId: "k", Start: 7 * time.Hour},
+				// kid's parent is decommissioned before the checkpoint
+				{Name: "p", ProtoId: "k", Lifetime: 2 * time.Hour, Children: []*AgentInfo{
+					{Name: "kid", ProtoId: "k"},
+				}},
+				{Name: "a", ProtoId: "k"},
+			},
+		}
+		l.Register(keeper{})
+		l.Engine.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+		return l
+	}
+
+	eventLog = nil
+	l := newLoader()
+	assert.NoErr(t, l.Build()).Fatal()
+	l.Engine.Run()
+	full := eventLog
+
+	eventLog = nil
+	l = newLoader()
+	assert.NoErr(t, l.Resume(fname)).Fatal()
+	l.Engine.Run()
+
+	assert.Eq(t, strings.Join(full, "\n"), strings.Join([]string{
+		"2h0m0s p ended",
+		"7h0m0s c",
+		"7h0m0s c ended",
+		"7h0m0s kid parent=p sender=p",
+		"7h0m0s a",
+		"7h0m0s d",
+		"9h0m0s kid ended",
+		"9h0m0s a ended",
+		"9h0m0s d ended",
+	}, "\n"))
+	assert.Eq(t, strings.Join(eventLog, "\n"), strings.Join(full[1:], "\n"))
+}
@@ -0,0 +1,80 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// AgentConfig is the effective configuration of an agent: its identity,
+// place in the agent tree and the marshalled exported fields of the
+// concrete agent (after prototype inheritance, decoding and any defaults
+// set by its Start method).
+type AgentConfig struct {
+	Id       int
+	Name     string
+	ParentId int
+	// ProtoId is the id of the prototype the agent was created from (if
+	// any).
+	ProtoId   string `json:",omitempty"`
+	Type      string
+	IsService bool
+	Config    json.RawMessage
+}
+
+// SimConfig is the effective configuration of a simulation.
+type SimConfig struct {
+	Start    time.Time
+	Duration time.Duration
+	Step     time.Duration
+	Seed     int64
+	Agents   []*AgentConfig
+}
+
+// AgentConfig returns the current effective configuration of agent a.
+func (e *Engine) AgentConfig(a Agent) (*AgentConfig, error) {
+	cfg := &AgentConfig{
+		Id:        a.Id(),
+		Name:      a.Name(),
+		ParentId:  agentId(a.Parent()),
+		Type:      typePath(a),
+		IsService: e.services[a.Name()] == a,
+	}
+	if e.Load != nil {
+		cfg.ProtoId = e.Load.protoOf[a]
+	}
+
+	var err error
+	if cfg.Config, err = json.Marshal(a); err != nil {
+		return nil, fmt.Errorf("sim: cannot marshal config of agent '%v': %v", a.Name(), err)
+	}
+	return cfg, nil
+}
+
+// Config returns the engine's settings and the effective configuration of
+// all currently deployed agents in id order.
+func (e *Engine) Config() (*SimConfig, error) {
+	cfg := &SimConfig{Start: e.Start, Duration: e.Duration, Step: e.Step, Seed: e.Seed}
+	for _, id := range e.agentIds() {
+		acfg, err := e.AgentConfig(e.agents[id])
+		if err != nil {
+			return nil, err
+		}
+		cfg.Agents = append(cfg.Agents, acfg)
+	}
+	return cfg, nil
+}
+
+// WriteConfig writes the result of Config to the file fname as json.
+func (e *Engine) WriteConfig(fname string) error {
+	cfg, err := e.Config()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, data, 0644)
+}
@@ -0,0 +1,129 @@
+package sim
+
+import (
+	"errors"
+	"time"
+)
+
+// DeployListener is implemented by entities that desire to receive
+// notifications every time an agent is deployed into or decommissioned from
+// a simulation.
+type DeployListener interface {
+	// Deployed is called after a has been registered with the engine.
+	Deployed(a Agent)
+	// Decommissioned is called after a has been removed from the engine -
+	// but, if a is a service, before it is unregistered (see GetService).
+	Decommissioned(a Agent)
+}
+
+// ListenDeploy adds l to the list of listeners notified of agent deployment
+// and decommissioning.  l is immediately notified (in id order) of the
+// deployment of all agents already registered with the engine.  Calling the
+// returned function removes l.
+func (e *Engine) ListenDeploy(l DeployListener) (unsubscribe func()) {
+	unsub := e.deployLis.add(l)
+	for _, id := range e.agentIds() {
+		l.Deployed(e.agents[id])
+	}
+	return unsub
+}
+
+// DeployAt schedules agent a to be registered with the engine (via
+// RegisterAll) at simulation time t.  Agents deployed during a time step
+// begin receiving notifications with the first phase that starts after
+// their deployment.
+func (e *Engine) DeployAt(t time.Time, a Agent) *Event {
+	return e.Schedule(t, func() { e.RegisterAll(a) })
+}
+
+// BuildAt creates a new agent named name from the loader prototype protoId
+// and schedules its deployment at simulation time t.  An error is returned
+// if the engine has no loader or the loader has no such prototype.
+func (e *Engine) BuildAt(t time.Time, protoId, name string, parent Agent) (Agent, error) {
+	if e.Load == nil {
+		return nil, errors.New("sim: engine has no loader to build agents from")
+	} else if _, ok := e.Load.protos[protoId]; !ok {
+		return nil, errors.New("sim: no prototype with id '" + protoId + "'")
+	}
+
+	a := e.Load.NewAgentFromProto(protoId, parent)
+	a.SetName(name)
+	e.DeployAt(t, a)
+	return a, nil
+}
+
+// Decommission removes agent a from the simulation.  Deploy listeners are
+// notified and then, if a implements Ender, its End method is called.  After
+// Decommission returns, a receives no further time-related notifications -
+// even if it is decommissioned partway through a phase in which it has not
+// yet been notified.  If a is registered as a service, it is also
+// unregistered.
+// Children of a keep a as their parent.
+func (e *Engine) Decommission(a Agent) {
+	if !e.deployed(a) {
+		return
+	}
+	delete(e.agents, a.Id())
+	delete(e.retire, a)
+	delete(e.rngs, a.Id())
+	delete(e.interceptors, a)
+
+	// slices are rebuilt rather than modified in place so that phases
+	// currently iterating over them are unaffected.
+	e.decayers = without(e.decayers, a)
+	e.tickers = without(e.tickers, a)
+	e.resolvers = without(e.resolvers, a)
+	e.tockers = without(e.tockers, a)
+	e.reporters = without(e.reporters, a)
+	e.enders = without(e.enders, a)
+
+	for _, l := range e.deployLis {
+		(*l).Decommissioned(a)
+	}
+	if s, ok := e.services[a.Name()]; ok && s == a {
+		delete(e.services, a.Name())
+	}
+	if en, ok := a.(Ender); ok {
+		en.End(e)
+	}
+}
+
+// DecommissionAt schedules agent a to be decommissioned at simulation time t.
+func (e *Engine) DecommissionAt(t time.Time, a Agent) *Event {
+	return e.decommissionAt(t, a, 0)
+}
+
+// decommissionAt is DecommissionAt with the event ordered by seq (see
+// scheduleSeq).
+func (e *Engine) decommissionAt(t time.Time, a Agent, seq int) *Event {
+	if e.retire == nil {
+		e.retire = map[Agent]*Event{}
+	}
+	ev := e.scheduleSeq(t, func() { e.Decommission(a) }, seq)
+	e.retire[a] = ev
+	return ev
+}
+
+// IsDeployed returns true if a is currently registered with the engine
+// (i.e. deployed and not yet decommissioned).
+func (e *Engine) IsDeployed(a Agent) bool {
+	return e.deployed(a)
+}
+
+// deployed returns true if x is an agent currently registered with the
+// engine.
+func (e *Engine) deployed(x interface{}) bool {
+	a, ok := x.(Agent)
+	return ok && e.agents[a.Id()] == a
+}
+
+// without returns a copy of s with all occurrences of agent a removed.
+func without[T any](s []T, a Agent) []T {
+	var rest []T
+	for _, x := range s {
+		if interface{}(x) != interface{}(a) {
+			rest = append(rest, x)
+		}
+	}
+	return rest
+}
@@ -0,0 +1,210 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Calendar durations used in input files.  A month is an average Gregorian
+// month (rounded to the minute) and a year is exactly 12 months.
+const (
+	Day   = 24 * time.Hour
+	Week  = 7 * Day
+	Month = 43829 * time.Minute
+	Year  = 12 * Month
+)
+
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  Day,
+	"w":  Week,
+	"mo": Month,
+	"y":  Year,
+}
+
+// ParseDuration parses a duration string such as "50y", "18mo", "1y6mo",
+// "30d" or "1.5h".  It accepts a sequence of decimal numbers, each with an
+// optional fraction and a unit suffix.  Valid units are those accepted by
+// time.ParseDuration plus "d" (Day), "w" (Week), "mo" (Month) and "y" (Year).
+// Note that "m" is a minute, not a month.
+func ParseDuration(s string) (time.Duration, error) {
+	orig := s
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg, s = true, s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	if s == "0" {
+		return 0, nil
+	} else if s == "" {
+		return 0, errors.New("sim: invalid duration '" + orig + "'")
+	}
+
+	var d time.Duration
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i <= 0 {
+			return 0, errors.New("sim: invalid duration '" + orig + "'")
+		}
+		num := s[:i]
+		s = s[i:]
+
+		j := strings.IndexFunc(s, func(r rune) bool { return (r >= '0' && r <= '9') || r == '.' })
+		if j < 0 {
+			j = len(s)
+		}
+		unit, ok := durationUnits[s[:j]]
+		if !ok {
+			return 0, errors.New("sim: unknown unit '" + s[:j] + "' in duration '" + orig + "'")
+		}
+		s = s[j:]
+
+		// whole units are converted exactly; only fractions are rounded
+		whole, frac, _ := strings.Cut(num, ".")
+		w, err := strconv.ParseInt("0"+whole, 10, 64)
+		if err != nil || w > (math.MaxInt64-int64(d))/int64(unit) {
+			return 0, errors.New("sim: invalid or overflowing duration '" + orig + "'")
+		}
+		d += time.Duration(w) * unit
+		if frac != "" {
+			f, err := strconv.ParseFloat("0."+frac, 64)
+			if err != nil {
+				return 0, errors.New("sim: invalid duration '" + orig + "'")
+			}
+			d += time.Duration(f * float64(unit))
+		}
+	}
+
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+var timeLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	time.RFC3339Nano,
+}
+
+// ParseTime parses a date such as "2025-01-01", a UTC time of day on a date
+// such as "2025-01-01T06:30" or an RFC 3339 time.
+func ParseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("sim: invalid date '" + s + "'")
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// normalizeTimes walks generic json data v (as decoded into an
+// interface{}) that will be decoded into a value of type t and replaces
+// human-readable strings destined for time.Duration and time.Time values
+// with the representations encoding/json expects (see ParseDuration and
+// ParseTime).  Unparseable strings are reported in errs with their json
+// path relative to path.
+func normalizeTimes(path string, v interface{}, t reflect.Type, errs *InputErrors) interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		if s, ok := v.(string); ok {
+			d, err := ParseDuration(s)
+			if err != nil {
+				*errs = append(*errs, &InputError{Path: path, Msg: err.Error()})
+				return v
+			}
+			return int64(d)
+		}
+	case t == timeType:
+		if s, ok := v.(string); ok {
+			tm, err := ParseTime(s)
+			if err != nil {
+				*errs = append(*errs, &InputError{Path: path, Msg: err.Error()})
+				return v
+			}
+			return tm.Format(time.RFC3339Nano)
+		}
+	case t.Kind() == reflect.Struct:
+		m, _ := v.(map[string]interface{})
+		for _, key := range sortedKeys(m) {
+			if f, ok := fieldByJSONName(t, key); ok {
+				m[key] = normalizeTimes(joinPath(path, key), m[key], f.Type, errs)
+			}
+		}
+	case t.Kind() == reflect.Map:
+		m, _ := v.(map[string]interface{})
+		for _, key := range sortedKeys(m) {
+			m[key] = normalizeTimes(fmt.Sprintf("%v[%q]", path, key), m[key], t.Elem(), errs)
+		}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		vals, _ := v.([]interface{})
+		for i := range vals {
+			vals[i] = normalizeTimes(fmt.Sprintf("%v[%v]", path, i), vals[i], t.Elem(), errs)
+		}
+	}
+	return v
+}
+
+// decodeJSON decodes the generic json data v into dst after normalizing
+// human-readable durations and times (see normalizeTimes).
+func decodeJSON(path string, v interface{}, dst interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	var errs InputErrors
+	raw = normalizeTimes(path, raw, reflect.TypeOf(dst), &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	data, _ = json.Marshal(raw)
+	return json.Unmarshal(data, dst)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
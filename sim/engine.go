@@ -2,42 +2,143 @@ package sim
 
 import (
 	"errors"
-	"fmt"
+	"github.com/rwcarlsen/goclus/trans"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Engine struct {
-	Duration  time.Duration
-	Step      time.Duration
-	Load      *Loader
-	services  map[string]Agent
-	tickers   []Ticker
-	resolvers []Resolver
-	tockers   []Tocker
-	starters  []Starter
-	enders    []Ender
-	tm        time.Time // current time (in the simulation)
-	nextId    int       // the next agent ID
+	// Start is the simulation time at which the simulation begins.  It
+	// defaults to the zero time.
+	Start    time.Time
+	Duration time.Duration
+	Step     time.Duration
+	// Seed is the master seed from which all agents' random number streams
+	// are derived.
+	Seed int64
+	// CheckpointEvery is the simulation time between automatic checkpoints.
+	// Zero disables automatic checkpointing.
+	CheckpointEvery time.Duration
+	// OutDir is the directory relative output file names (e.g. log,
+	// checkpoint and book-keeping files) are resolved against.  It defaults to
+	// the current working directory.
+	OutDir string
+	// CheckpointFile is the file automatic checkpoints are written to.  It
+	// defaults to "checkpoint.json".
+	CheckpointFile string
+	// LogLevel is the minimum level of log records written (e.g. "DEBUG",
+	// "INFO", "WARN" or "ERROR").  It defaults to INFO.
+	LogLevel slog.Level
+	// LogFile is the file log records are written to.  It defaults to
+	// stderr.
+	LogFile string
+	// LogFormat selects between "text" (the default) and "json" (one json
+	// object per line) log records.
+	LogFormat string
+	// TickWorkers is the number of goroutines that run agents' Tick methods
+	// concurrently.  Values less than 2 run tickers sequentially (the
+	// default).  Messages sent during a parallel Tick phase are delivered
+	// after all tickers return, in the order a sequential run would deliver
+	// them, so results match the sequential run as long as every ticker
+	// only modifies its own state, only sends messages it owns without
+	// depending on their delivery (e.g. offers and requests to markets) and
+	// only uses engine methods that don't modify the simulation (e.g. Time,
+	// GetService, Logger and Rand).  In particular, tickers must not
+	// schedule events or deploy or decommission agents.
+	TickWorkers int
+	// TraceMsgs enables recording the timeline of every message passage
+	// between agents (see MsgTraces).
+	TraceMsgs bool
+	// AsyncMsgs switches message delivery from immediate to queued: instead
+	// of calling the next agent's Receive method, SendOn queues the message
+	// on the engine.  Queued messages are delivered one at a time - so no
+	// agent's Receive method is ever re-entered - and in the order they
+	// were sent - so each agent receives its messages first in, first out.
+	// Unless MsgLatency is set, messages are delivered at the end of the
+	// phase (or event) in which they were sent, including messages sent
+	// during delivery.
+	AsyncMsgs bool
+	// MsgLatency is the simulated time it takes every queued message to
+	// reach the next agent.  Messages are delivered as events (see
+	// Schedule), so a message sent during a phase arrives between time
+	// steps at the earliest.
+	MsgLatency   time.Duration
+	Load         *Loader
+	services     map[string]Agent
+	agents       map[int]Agent // all currently deployed agents by id
+	retire       map[Agent]*Event
+	rngs         map[int]*rngStream
+	rngMu        sync.Mutex              // guards rngs during parallel ticks
+	outbox       map[uint64]**[]*Message // current ticker outbox by worker goroutine id
+	outboxMu     sync.Mutex              // guards outbox during parallel ticks
+	nextCkpt     time.Time
+	log          *slog.Logger
+	logFile      *os.File
+	deployLis    listeners[DeployListener]
+	msgLis       listeners[MsgListener]
+	interceptors map[Agent]*listeners[Interceptor]
+	transLis     trans.Notifier
+	decayers     []Decayer
+	tickers      []Ticker
+	resolvers    []Resolver
+	tockers      []Tocker
+	reporters    []Reporter
+	starters     []Starter
+	enders       []Ender
+	events       eventQueue
+	eventSeq     int
+	nextMsgId    int
+	traces       []*MsgTrace // in message id order
+	phase        Phase       // the currently running phase
+	msgQueue     []*Message  // messages awaiting asynchronous delivery
+	inFlight     int         // number of asynchronous messages not yet delivered
+	tm           time.Time   // current time (in the simulation)
+	begun        bool        // whether tm has been set to Start
+	closed       bool        // whether Close was called
+	nextId       int         // the next agent ID
 }
 
 // RegisterAll registers agent a to receive time-related notifications for
-// all sim package interfaces implemented.
+// all sim package interfaces implemented.  Within each phase, a runs in
+// order of its priority (see Prioritizer).
 func (e *Engine) RegisterAll(a Agent) (ifaces []string) {
+	// listeners added during a's Start are notified of a by ListenDeploy
+	lis := e.deployLis
+
+	e.initLog()
 	e.nextId++
 	a.SetId(e.nextId)
+	if e.agents == nil {
+		e.agents = map[int]Agent{}
+	}
+	e.agents[a.Id()] = a
+	if h, ok := a.(engineHolder); ok {
+		h.setEngine(e)
+	}
 
+	if t, ok := a.(Decayer); ok {
+		e.decayers = insertPhase(e.decayers, t, DecayPhase)
+		ifaces = append(ifaces, "Decayer")
+	}
 	if t, ok := a.(Ticker); ok {
-		e.tickers = append(e.tickers, t)
+		e.tickers = insertPhase(e.tickers, t, TickPhase)
 		ifaces = append(ifaces, "Ticker")
 	}
 	if t, ok := a.(Tocker); ok {
-		e.tockers = append(e.tockers, t)
+		e.tockers = insertPhase(e.tockers, t, TockPhase)
 		ifaces = append(ifaces, "Tocker")
 	}
 	if t, ok := a.(Resolver); ok {
-		e.resolvers = append(e.resolvers, t)
+		e.resolvers = insertPhase(e.resolvers, t, ResolvePhase)
 		ifaces = append(ifaces, "Resolver")
 	}
+	if t, ok := a.(Reporter); ok {
+		e.reporters = insertPhase(e.reporters, t, ReportPhase)
+		ifaces = append(ifaces, "Reporter")
+	}
 	if t, ok := a.(Starter); ok {
 		t.Start(e)
 	}
@@ -45,6 +146,10 @@ func (e *Engine) RegisterAll(a Agent) (ifaces []string) {
 		e.enders = append(e.enders, t)
 		ifaces = append(ifaces, "Ender")
 	}
+
+	for _, l := range lis {
+		(*l).Deployed(a)
+	}
 	return ifaces
 }
 
@@ -79,34 +184,126 @@ func (e *Engine) GetService(id string) (Agent, error) {
 
 func (e *Engine) Run() {
 	e.runTimeSteps()
+	e.Close()
+}
+
+// Close ends the simulation: the End methods of all Enders are called and
+// the log file is closed.  Run calls Close when the simulation finishes;
+// calling Close directly is only necessary to release the resources of a
+// simulation that didn't finish (e.g. because an agent panicked).  Calls
+// after the first do nothing.
+func (e *Engine) Close() {
+	if e.closed {
+		return
+	}
+	e.closed = true
 	for _, en := range e.enders {
 		en.End(e)
 	}
+	e.closeLog()
 }
 
 func (e *Engine) runTimeSteps() {
-	end := e.tm.Add(e.Duration)
-	for ; e.tm.Before(end); e.tm = e.tm.Add(e.Step) {
-		fmt.Println("timestep: ", e.tm)
-		fmt.Println("ticking...")
-		for _, t := range e.tickers {
-			t.Tick()
+	e.begin()
+	end := e.Start.Add(e.Duration)
+	now := e.tm
+	e.nextCkpt = now.Add(e.CheckpointEvery)
+	log := e.Logger(nil)
+	for ; now.Before(end); now = now.Add(e.Step) {
+		e.tm = now
+		e.autoCheckpoint()
+		e.runEvents(now, true)
+
+		log.Debug("timestep")
+		log.Debug("decaying")
+		e.enterPhase(DecayPhase)
+		for _, d := range e.decayers {
+			if e.deployed(d) {
+				d.Decay()
+			}
 		}
-		fmt.Println("resolving...")
+		log.Debug("ticking")
+		e.enterPhase(TickPhase)
+		e.tick()
+		log.Debug("resolving")
+		e.enterPhase(ResolvePhase)
 		for _, r := range e.resolvers {
-			r.Resolve()
+			if e.deployed(r) {
+				r.Resolve()
+			}
 		}
-		fmt.Println("tocking...")
+		log.Debug("tocking")
+		e.enterPhase(TockPhase)
 		for _, t := range e.tockers {
-			t.Tock()
+			if e.deployed(t) {
+				t.Tock()
+			}
+		}
+		log.Debug("reporting")
+		e.enterPhase(ReportPhase)
+		for _, r := range e.reporters {
+			if e.deployed(r) {
+				r.Report()
+			}
+		}
+
+		e.enterPhase(EventPhase)
+		next := now.Add(e.Step)
+		if next.After(end) {
+			next = end
 		}
+		e.runEvents(next, false)
 	}
+	e.tm = now
+}
+
+// autoCheckpoint writes a checkpoint if one is due.  Checkpoints are taken
+// at the beginning of a time step before any events due at that time fire.
+func (e *Engine) autoCheckpoint() {
+	if e.CheckpointEvery <= 0 || e.tm.Before(e.nextCkpt) {
+		return
+	}
+	e.nextCkpt = e.tm.Add(e.CheckpointEvery)
+
+	fname := e.CheckpointFile
+	if fname == "" {
+		fname = "checkpoint.json"
+	}
+	fname = e.OutPath(fname)
+	if err := e.Checkpoint(fname); err != nil {
+		e.Logger(nil).Error("checkpoint failed", "err", err)
+	} else {
+		e.Logger(nil).Info("checkpoint written", "file", fname)
+	}
+}
+
+// OutPath returns the path of the output file name resolved against the
+// engine's OutDir.
+func (e *Engine) OutPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(e.OutDir, name)
 }
 
 func (e *Engine) Time() time.Time {
+	if !e.begun {
+		return e.Start
+	}
 	return e.tm
 }
 
 func (e *Engine) SinceStart() time.Duration {
-	return e.tm.Sub(time.Time{})
+	return e.Time().Sub(e.Start)
+}
+
+// begin sets the engine's clock to Start unless the simulation already
+// began (or was resumed from a checkpoint).  It is called when the
+// simulation is built and when it runs.
+func (e *Engine) begin() {
+	e.initLog()
+	if !e.begun {
+		e.tm = e.Start
+		e.begun = true
+	}
 }
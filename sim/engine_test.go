@@ -0,0 +1,548 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rwcarlsen/goclus/rsrc"
+	"github.com/rwcarlsen/goclus/trans"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder is a test agent that logs the phases it is notified of.
+type recorder struct {
+	Agenty
+	eng *Engine
+	log *[]string
+}
+
+func (r *recorder) Start(e *Engine) { r.eng = e }
+func (r *recorder) Tick()           { *r.log = append(*r.log, "tick") }
+func (r *recorder) Tock()           { *r.log = append(*r.log, "tock") }
+
+func TestEventOrder(t *testing.T) {
+	var log []string
+	eng := &Engine{Duration: 2 * time.Hour, Step: time.Hour}
+	eng.RegisterAll(&recorder{log: &log})
+
+	var at []time.Time
+	mark := func(s string) func() {
+		return func() {
+			log = append(log, s)
+			at = append(at, eng.Time())
+		}
+	}
+	start := eng.Time()
+	eng.Schedule(start.Add(90*time.Minute), mark("b"))
+	eng.Schedule(start.Add(time.Hour), mark("a1"))
+	eng.Schedule(start.Add(time.Hour), mark("a2"))
+	eng.Schedule(start.Add(5*time.Hour), mark("never"))
+	eng.Schedule(start.Add(30*time.Minute), mark("canceled")).Cancel()
+	eng.Run()
+
+	expected := []string{"tick", "tock", "a1", "a2", "tick", "tock", "b"}
+	assert.Eq(t, len(log), len(expected)).Fatal()
+	for i := range expected {
+		assert.Eq(t, log[i], expected[i])
+	}
+	assert.Eq(t, at[2], start.Add(90*time.Minute))
+}
+
+// phased is a test agent that takes part in every phase with a priority.
+type phased struct {
+	Agenty
+	name string
+	pri  int
+	log  *[]string
+}
+
+func (p *phased) Priority(Phase) int { return p.pri }
+func (p *phased) Decay()             { p.record(DecayPhase) }
+func (p *phased) Tick()              { p.record(TickPhase) }
+func (p *phased) Resolve()           { p.record(ResolvePhase) }
+func (p *phased) Tock()              { p.record(TockPhase) }
+func (p *phased) Report()            { p.record(ReportPhase) }
+func (p *phased) record(ph Phase)    { *p.log = append(*p.log, ph.String()+" "+p.name) }
+
+func TestPhases(t *testing.T) {
+	var log []string
+	eng := &Engine{Duration: time.Hour, Step: time.Hour}
+	eng.RegisterAll(&phased{name: "b", log: &log})
+	eng.RegisterAll(&phased{name: "c", pri: 1, log: &log})
+	eng.RegisterAll(&phased{name: "a", pri: -1, log: &log})
+	eng.RegisterAll(&phased{name: "b2", log: &log})
+	eng.Run()
+
+	got := strings.Join(log, ", ")
+	expected := []string{}
+	for _, ph := range []string{"decay", "tick", "resolve", "tock", "report"} {
+		for _, name := range []string{"a", "b", "b2", "c"} {
+			expected = append(expected, ph+" "+name)
+		}
+	}
+	assert.Eq(t, got, strings.Join(expected, ", "))
+}
+
+// sender is a test agent that sends n messages to recv every tick.
+type sender struct {
+	Agenty
+	recv Agent
+	n    int
+}
+
+func (s *sender) Tick() {
+	for i := 0; i < s.n; i++ {
+		m := NewMsg(s, s.recv)
+		m.Payload = fmt.Sprintf("%v.%v", s.Id(), i)
+		m.SendOn()
+	}
+}
+
+// collector is a test agent that records the messages and payloads it
+// receives.
+type collector struct {
+	Agenty
+	got  []string
+	msgs []*Message
+}
+
+func (c *collector) Receive(m *Message) {
+	c.got = append(c.got, m.Payload.(string))
+	c.msgs = append(c.msgs, m)
+}
+
+func TestParallelTick(t *testing.T) {
+	run := func(workers int) string {
+		eng := &Engine{Duration: 3 * time.Hour, Step: time.Hour, TickWorkers: workers}
+		c := &collector{}
+		eng.RegisterAll(c)
+		for i := 0; i < 50; i++ {
+			eng.RegisterAll(&sender{recv: c, n: i % 4})
+		}
+		eng.Run()
+		return strings.Join(c.got, " ")
+	}
+
+	seq := run(0)
+	assert.Ne(t, seq, "")
+	assert.Eq(t, run(8), seq)
+}
+
+// proxy is a test agent that sends a message on behalf of another agent in
+// its Tick, from a new goroutine if async is true.
+type proxy struct {
+	Agenty
+	owner, recv Agent
+	async       bool
+}
+
+func (p *proxy) Tick() {
+	m := NewMsg(p.owner, p.recv)
+	m.Payload = p.Name()
+	if !p.async {
+		m.SendOn()
+		return
+	}
+	done := make(chan interface{})
+	go func() {
+		defer func() { done <- recover() }()
+		m.SendOn()
+	}()
+	if r := <-done; r != nil {
+		panic(r)
+	}
+}
+
+func TestParallelTickOwners(t *testing.T) {
+	eng := &Engine{Duration: time.Hour, Step: time.Hour, TickWorkers: 4}
+	c, kid := &collector{}, &Agenty{}
+	eng.RegisterAll(c)
+	eng.RegisterAll(kid)
+	// both proxies send messages owned by kid, which isn't a ticker
+	for i := 0; i < 2; i++ {
+		p := &proxy{owner: kid, recv: c}
+		p.SetName(fmt.Sprint("p", i))
+		eng.RegisterAll(p)
+	}
+	eng.Run()
+	assert.Eq(t, strings.Join(c.got, " "), "p0 p1")
+
+	eng = &Engine{Duration: time.Hour, Step: time.Hour, TickWorkers: 4}
+	c = &collector{}
+	eng.RegisterAll(c)
+	p := &proxy{recv: c, async: true}
+	p.owner = p
+	eng.RegisterAll(p)
+	defer func() { assert.Ne(t, recover(), nil) }()
+	eng.Run()
+}
+
+// echo is a test agent that returns every message it receives.
+type echo struct{ Agenty }
+
+func (e *echo) Receive(m *Message) {
+	m.Dir = DownMsg
+	m.SendOn()
+}
+
+func TestMsgTrace(t *testing.T) {
+	eng := &Engine{Duration: 2 * time.Hour, Step: time.Hour, TraceMsgs: true}
+	c, par, recv := &collector{}, &Agenty{}, &echo{}
+	s := &sender{recv: recv, n: 1}
+	for i, a := range []Agent{c, par, recv, s} {
+		a.SetName(fmt.Sprint("a", i))
+		eng.RegisterAll(a)
+	}
+	s.SetParent(par)
+	eng.Run()
+
+	// the parent drops messages - so only their first hop is made
+	traces := eng.MsgTraces()
+	assert.Eq(t, len(traces), 2).Fatal()
+	assert.Eq(t, traces[0].Id, 1)
+	assert.Eq(t, traces[1].Id, 2)
+	assert.Eq(t, len(traces[0].Hops), 1).Fatal()
+	h := traces[0].Hops[0]
+	assert.Eq(t, h.Phase, TickPhase)
+	assert.Eq(t, h.PrevOwner, "a3")
+	assert.Eq(t, h.Owner, "a1")
+	assert.Eq(t, traces[1].Hops[0].Time, eng.Start.Add(time.Hour))
+
+	// direct sends travel up and back down
+	s.SetParent(nil)
+	m := NewMsg(s, recv)
+	assert.Eq(t, m.Id(), 0)
+	m.SendOn()
+	assert.Eq(t, m.Id(), 3)
+	hops := []string{}
+	for _, h := range m.Trace().Hops {
+		hops = append(hops, h.Dir+":"+h.PrevOwner+">"+h.Owner)
+	}
+	assert.Eq(t, strings.Join(hops, " "), "up:a3>a2 down:a2>a3")
+	assert.Eq(t, m.Clone().Id(), 0)
+}
+
+// relay is a test agent that sends every message it receives on to peer
+// until it was sent hops times and logs the receptions and its maximum
+// Receive call depth.
+type relay struct {
+	Agenty
+	peer       Agent
+	hops       int
+	log        *[]string
+	at         *[]time.Time
+	depth, max int
+}
+
+func (r *relay) Receive(m *Message) {
+	r.depth++
+	if r.depth > r.max {
+		r.max = r.depth
+	}
+	n := m.Payload.(int)
+	*r.log = append(*r.log, fmt.Sprint(r.Name(), n))
+	*r.at = append(*r.at, r.eng.Time())
+	if n < r.hops {
+		fwd := NewMsg(r, r.peer)
+		fwd.Payload = n + 1
+		fwd.SendOn()
+	}
+	r.depth--
+}
+
+func TestAsyncMsgs(t *testing.T) {
+	run := func(latency time.Duration) (*relay, []string, []time.Time) {
+		var log []string
+		var at []time.Time
+		eng := &Engine{Duration: 2 * time.Hour, Step: time.Hour, AsyncMsgs: true, MsgLatency: latency}
+		a := &relay{hops: 4, log: &log, at: &at}
+		b := &relay{peer: a, hops: 4, log: &log, at: &at}
+		a.peer = b
+		a.SetName("a")
+		b.SetName("b")
+		eng.RegisterAll(a)
+		eng.RegisterAll(b)
+
+		// two chains to the same agents interleave in sending order
+		for i := 0; i < 2; i++ {
+			m := NewMsg(a, b)
+			m.Payload = 2 * i
+			m.SendOn()
+		}
+		assert.Eq(t, len(log), 0)
+		eng.Run()
+		return a, log, at
+	}
+
+	a, log, _ := run(0)
+	assert.Eq(t, strings.Join(log, " "), "b0 b2 a1 a3 b2 b4 a3 b4")
+	assert.Eq(t, a.max, 1)
+
+	// each hop takes 20 minutes
+	_, log, at := run(20 * time.Minute)
+	assert.Eq(t, strings.Join(log, " "), "b0 b2 a1 a3 b2 b4 a3 b4")
+	assert.Eq(t, at[0].Sub(time.Time{}), 20*time.Minute)
+	assert.Eq(t, at[7].Sub(time.Time{}), 100*time.Minute)
+}
+
+// forwarder is a test agent that passes on messages for other agents.
+type forwarder struct{ Agenty }
+
+func (f *forwarder) Receive(m *Message) {
+	if m.Receiver() != Agent(f) {
+		m.SendOn()
+	}
+}
+
+func TestAddressedMsgs(t *testing.T) {
+	eng := &Engine{}
+	root, mid := &forwarder{}, &forwarder{}
+	leaf1, leaf2, other := &collector{}, &collector{}, &collector{}
+	mid.SetParent(root)
+	leaf1.SetParent(mid)
+	leaf2.SetParent(mid)
+	for _, a := range []Agent{root, mid, leaf1, leaf2, other} {
+		a.SetName("x")
+		eng.RegisterAll(a)
+	}
+	leaf2.SetName("leaf")
+	other.SetName("leaf")
+
+	send := func(from Agent, addr Addr) string {
+		m := NewMsgTo(from, addr)
+		m.Payload = "hi"
+		m.SendOn()
+		ids := []string{}
+		for _, c := range m.Clones() {
+			ids = append(ids, fmt.Sprint(c.Receiver().Id()))
+		}
+		return strings.Join(ids, " ")
+	}
+
+	assert.Eq(t, send(root, ToSubtree(root)), "2 3 4")
+	assert.Eq(t, send(mid, ToSubtree(mid)), "3 4")
+	assert.Eq(t, send(root, ToName("leaf")), "4 5")
+	assert.Eq(t, send(other, ToType("github.com/rwcarlsen/goclus/sim.collector")), "3 4")
+	assert.Eq(t, send(root, ToType("nonexistent")), "")
+	assert.Eq(t, send(leaf1, ToAll()), "1 2 4 5")
+
+	// clones from within the subtree travel up through the parents
+	assert.Eq(t, len(leaf1.got), 3)
+	assert.Eq(t, len(leaf2.got), 5)
+	assert.Eq(t, len(other.got), 2)
+}
+
+func TestIntercept(t *testing.T) {
+	eng := &Engine{}
+	par, snd, recv, alt := &forwarder{}, &collector{}, &collector{}, &collector{}
+	snd.SetParent(par)
+	for _, a := range []Agent{par, snd, recv, alt} {
+		eng.RegisterAll(a)
+	}
+
+	var order []string
+	eng.Intercept(par, InterceptorFunc(func(m *Message, next func()) {
+		order = append(order, "first")
+		if m.Payload == "long" {
+			m.Payload = "short"
+		}
+		next()
+	}))
+	remove := eng.Intercept(par, InterceptorFunc(func(m *Message, next func()) {
+		order = append(order, "second")
+		switch m.Payload {
+		case "bad":
+			m.Reject("not allowed")
+		case "elsewhere":
+			m.SetNext(alt)
+			m.SendOn()
+		default:
+			next()
+		}
+	}))
+
+	send := func(payload string) *Message {
+		m := NewMsg(snd, recv)
+		m.Payload = payload
+		m.SendOn()
+		return m
+	}
+	send("long")
+	assert.Eq(t, strings.Join(order, " "), "first second")
+	send("elsewhere")
+	m := send("bad")
+	assert.Eq(t, strings.Join(recv.got, " "), "short")
+	assert.Eq(t, strings.Join(alt.got, " "), "elsewhere")
+	assert.Eq(t, len(snd.msgs), 1).Fatal()
+	assert.Eq(t, snd.msgs[0], m)
+	assert.Eq(t, m.Dir, DownMsg)
+	assert.Eq(t, m.Rejection(), "not allowed")
+
+	remove()
+	send("bad")
+	assert.Eq(t, strings.Join(recv.got, " "), "short bad")
+}
+
+func TestScheduleIn(t *testing.T) {
+	eng := &Engine{Duration: 10 * time.Hour, Step: time.Hour}
+	var fired []time.Duration
+	var f func()
+	f = func() {
+		fired = append(fired, eng.SinceStart())
+		eng.ScheduleIn(3*time.Hour, f)
+	}
+	eng.ScheduleIn(time.Hour, f)
+	eng.Run()
+
+	expected := []time.Duration{time.Hour, 4 * time.Hour, 7 * time.Hour}
+	assert.Eq(t, len(fired), len(expected)).Fatal()
+	for i := range expected {
+		assert.Eq(t, fired[i], expected[i])
+	}
+}
+
+func TestTimeBeforeRun(t *testing.T) {
+	eng := &Engine{Duration: 3 * time.Hour, Step: time.Hour}
+	assert.Eq(t, eng.Time(), time.Time{})
+
+	// reading the clock must not pin it to the old Start
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	eng.Start = start
+	assert.Eq(t, eng.Time(), start)
+	var first time.Time
+	eng.ScheduleIn(time.Hour, func() { first = eng.Time() })
+	eng.Run()
+	assert.Eq(t, first, start.Add(time.Hour))
+	assert.Eq(t, eng.SinceStart(), 3*time.Hour)
+}
+
+func TestDecommission(t *testing.T) {
+	var log1, log2 []string
+	eng := &Engine{Duration: 4 * time.Hour, Step: time.Hour}
+	a1 := &recorder{log: &log1}
+	a2 := &recorder{log: &log2}
+	eng.RegisterAll(a1)
+	eng.DeployAt(eng.Time().Add(time.Hour), a2)
+	eng.DecommissionAt(eng.Time().Add(90*time.Minute), a1)
+	eng.Run()
+
+	assert.Eq(t, len(log1), 4)
+	assert.Eq(t, len(log2), 6)
+	assert.Eq(t, eng.deployed(a1), false)
+	assert.Eq(t, eng.deployed(a2), true)
+}
+
+func TestRand(t *testing.T) {
+	draws := func(seed int64) (x, y uint64) {
+		eng := &Engine{Seed: seed}
+		a1, a2 := &recorder{}, &recorder{}
+		eng.RegisterAll(a1)
+		eng.RegisterAll(a2)
+		return eng.Rand(a1).Uint64(), eng.Rand(a2).Uint64()
+	}
+
+	x1, y1 := draws(1)
+	x2, y2 := draws(1)
+	x3, _ := draws(2)
+	assert.Eq(t, x1, x2)
+	assert.Eq(t, y1, y2)
+	assert.Ne(t, x1, y1)
+	assert.Ne(t, x1, x3)
+}
+
+type msgCounter struct{ n int }
+
+func (c *msgCounter) MsgNotify(*Message) { c.n++ }
+
+func TestListenMsgs(t *testing.T) {
+	eng1, eng2 := &Engine{}, &Engine{}
+	a, b := &recorder{}, &recorder{}
+	eng1.RegisterAll(a)
+	eng1.RegisterAll(b)
+	eng2.RegisterAll(&recorder{})
+
+	c1, c2 := &msgCounter{}, &msgCounter{}
+	unsub := eng1.ListenMsgs(c1)
+	eng2.ListenMsgs(c2)
+
+	NewMsg(a, b).SendOn()
+	assert.Eq(t, c1.n, 1)
+	assert.Eq(t, c2.n, 0)
+
+	unsub()
+	NewMsg(a, b).SendOn()
+	assert.Eq(t, c1.n, 1)
+}
+
+// resTrader is a test agent that supplies and requests resources.
+type resTrader struct{ Agenty }
+
+func (r *resTrader) RemoveResource(*trans.Transaction) {}
+func (r *resTrader) AddResource(*trans.Transaction)    {}
+
+type transCounter struct{ n int }
+
+func (c *transCounter) TransNotify(*trans.Transaction) { c.n++ }
+
+func TestListenTransUnsent(t *testing.T) {
+	eng := &Engine{}
+	sup, req := &resTrader{}, &resTrader{}
+	eng.RegisterAll(sup)
+	eng.RegisterAll(req)
+	c := &transCounter{}
+	eng.ListenTrans(c)
+
+	// approved without being sent in a message
+	tr := trans.NewOffer(sup)
+	tr.SetResource(rsrc.NewGeneric(1, "kg"))
+	tr.MatchWith(trans.NewRequest(req))
+	assert.NoErr(t, tr.Approve())
+	assert.Eq(t, c.n, 1)
+
+	// transactions of agents outside of any engine are not recorded
+	tr = trans.NewOffer(&resTrader{})
+	tr.SetResource(rsrc.NewGeneric(1, "kg"))
+	tr.MatchWith(trans.NewRequest(&resTrader{}))
+	assert.Eq(t, tr.Approve(), trans.ErrUnrecorded)
+	assert.Eq(t, c.n, 1)
+}
+
+// chatter is a test agent that logs a record in every Tick.
+type chatter struct {
+	Agenty
+	log *slog.Logger
+}
+
+func (c *chatter) Start(e *Engine) { c.log = e.Logger(c) }
+func (c *chatter) Tick()           { c.log.Info("tick") }
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	eng := &Engine{Duration: 2 * time.Hour, Step: time.Hour}
+	eng.SetLogHandler(slog.NewJSONHandler(&buf, nil))
+	c := &chatter{}
+	c.SetName("c")
+	eng.RegisterAll(&Agenty{})
+	eng.RegisterAll(c)
+	eng.Run()
+
+	var recs []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec struct {
+			Msg     string
+			Agent   string
+			Id      int
+			Simtime time.Time
+		}
+		assert.NoErr(t, dec.Decode(&rec)).Fatal()
+		if rec.Msg == "tick" {
+			recs = append(recs, fmt.Sprint(rec.Agent, " ", rec.Id, " ", rec.Simtime.Sub(eng.Start)))
+		}
+	}
+	assert.Eq(t, strings.Join(recs, "\n"), "c 2 0s\nc 2 1h0m0s")
+}
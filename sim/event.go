@@ -0,0 +1,103 @@
+package sim
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Event is a callback scheduled to fire at a specific simulation time via
+// an Engine's Schedule method.
+type Event struct {
+	// Time is the simulation time at which the event fires.
+	Time     time.Time
+	fn       func()
+	seq      int
+	canceled bool
+}
+
+// Cancel prevents the event from firing.  Canceling an event that has
+// already fired does nothing.
+func (ev *Event) Cancel() {
+	ev.canceled = true
+}
+
+// eventQueue is a priority queue of events ordered by time.  Events
+// scheduled for the same time are ordered by the sequence in which they were
+// scheduled.
+type eventQueue []*Event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].Time.Equal(q[j].Time) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].Time.Before(q[j].Time)
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*Event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
+
+// Schedule arranges for fn to be called at simulation time t.  Events
+// scheduled for a time earlier than the current simulation time fire at the
+// next opportunity.
+//
+// Events due at the beginning of a time step fire before that step's Decay
+// phase.  Events due between two time steps fire after the earlier step's
+// Report phase with the engine's clock set to the event's time.  Events with
+// identical times fire in the order they were scheduled.
+func (e *Engine) Schedule(t time.Time, fn func()) *Event {
+	return e.scheduleSeq(t, fn, 0)
+}
+
+// scheduleSeq schedules fn like Schedule but orders it among events at the
+// same time by seq (e.g. the order of a restored event) unless seq is zero.
+func (e *Engine) scheduleSeq(t time.Time, fn func(), seq int) *Event {
+	if now := e.Time(); t.Before(now) {
+		t = now
+	}
+	if seq == 0 {
+		e.eventSeq++
+		seq = e.eventSeq
+	}
+	ev := &Event{Time: t, fn: fn, seq: seq}
+	heap.Push(&e.events, ev)
+	return ev
+}
+
+// ScheduleIn arranges for fn to be called after simulation duration d has
+// elapsed from the current simulation time.
+func (e *Engine) ScheduleIn(d time.Duration, fn func()) *Event {
+	return e.Schedule(e.Time().Add(d), fn)
+}
+
+// runEvents fires, in order, all scheduled events due before until (or at
+// until if incl is true).  The engine clock is moved forward to each event's
+// time as it fires.
+func (e *Engine) runEvents(until time.Time, incl bool) {
+	for len(e.events) > 0 {
+		ev := e.events[0]
+		if !ev.Time.Before(until) && !(incl && ev.Time.Equal(until)) {
+			return
+		}
+		heap.Pop(&e.events)
+		if ev.canceled {
+			continue
+		}
+		if ev.Time.After(e.tm) {
+			e.tm = ev.Time
+		}
+		ev.fn()
+		e.flushMsgs()
+	}
+}
@@ -0,0 +1,85 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FormatOf returns the input format implied by the extension of fname:
+// "yaml" for .yaml and .yml files, "toml" for .toml files and "json"
+// otherwise.
+func FormatOf(fname string) string {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// parseInput parses input data in the given format into generic json data
+// (i.e. the values encoding/json decodes into an interface{}).
+func parseInput(data []byte, format string) (interface{}, error) {
+	var raw interface{}
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&raw); err != nil {
+			return nil, prettyParseError(string(data), err)
+		}
+		return raw, nil
+	case "yaml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, errors.New("loader: " + err.Error())
+		}
+	case "toml":
+		m := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, errors.New("loader: " + err.Error())
+		}
+		raw = m
+	default:
+		return nil, errors.New("loader: unknown input format '" + format + "'")
+	}
+	return jsonable(raw), nil
+}
+
+// jsonable converts values decoded from yaml or toml that encoding/json
+// can't handle (or handles differently) into their generic json
+// equivalents.
+func jsonable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = jsonable(val)
+		}
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, val := range v {
+			m[fmt.Sprint(key)] = jsonable(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = jsonable(val)
+		}
+	case []map[string]interface{}:
+		vals := []interface{}{}
+		for _, val := range v {
+			vals = append(vals, jsonable(val))
+		}
+		return vals
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
@@ -0,0 +1,87 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// includes tracks the input files decoded while decoding an input file.
+type includes struct {
+	stack []string        // files currently being decoded, outermost first
+	seen  map[string]bool // files already decoded
+}
+
+// decodeFile decodes the input file fname and, recursively, the files it
+// includes into l.  Prototypes and agents from included files are added
+// before those of the including file.  Each file is decoded only once, even
+// if included several times.  Only the top-level file may declare an Engine
+// or a Sweep, and a prototype id may only be declared once among all files.
+func (l *Loader) decodeFile(fname, format string, inc *includes) error {
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		return err
+	}
+	for i, f := range inc.stack {
+		if f == abs {
+			cycle := strings.Join(append(inc.stack[i:], abs), " -> ")
+			return errors.New("loader: include cycle " + cycle)
+		}
+	}
+	if inc.seen[abs] {
+		return nil
+	}
+	inc.seen[abs] = true
+
+	top := len(inc.stack) == 0
+	in, err := decodeOne(fname, format)
+	if err != nil && !top {
+		return fmt.Errorf("loader: included file %v: %v", fname, strings.TrimPrefix(err.Error(), "loader: "))
+	} else if err != nil {
+		return err
+	}
+
+	inc.stack = append(inc.stack, abs)
+	for _, name := range in.Include {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(fname), name)
+		}
+		if err := l.decodeFile(name, FormatOf(name), inc); err != nil {
+			return err
+		}
+	}
+	inc.stack = inc.stack[:len(inc.stack)-1]
+
+	if top {
+		l.Include, l.Engine, l.Sweep = in.Include, in.Engine, in.Sweep
+	} else if in.Engine != nil || len(in.Sweep) > 0 {
+		return errors.New("loader: included file " + fname + " may not declare an Engine or Sweep")
+	}
+	if l.Prototypes == nil {
+		l.Prototypes = map[string]*ProtoInfo{}
+	}
+	for _, id := range sortedKeys(in.Prototypes) {
+		if _, ok := l.Prototypes[id]; ok {
+			return errors.New("loader: prototype '" + id + "' in " + fname + " is already declared in an included file")
+		}
+		l.Prototypes[id] = in.Prototypes[id]
+	}
+	l.Agents = append(l.Agents, in.Agents...)
+	return nil
+}
+
+// decodeOne decodes the input file fname (without its includes).
+func decodeOne(fname, format string) (*Loader, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := parseInput(data, format)
+	if err != nil {
+		return nil, err
+	}
+	in := &Loader{}
+	return in, decodeJSON("", raw, in)
+}
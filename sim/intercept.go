@@ -0,0 +1,91 @@
+package sim
+
+// Interceptor inspects messages arriving at an agent before the agent
+// receives them, e.g. so that an institution can enforce trading policies on
+// the messages its children send through it.  Intercept may modify m.
+// Calling next passes m on to the agent's remaining interceptors and finally
+// to its Receive method.  An interceptor that doesn't call next stops the
+// message: it may drop it, reject it back to its sender (see Reject) or
+// re-route it (by calling SetNext and SendOn).
+//
+// Interceptors installed on an agent with Engine.Intercept run in the order
+// they were installed.  An agent that implements Interceptor itself
+// intercepts its messages after all installed interceptors.
+type Interceptor interface {
+	Intercept(m *Message, next func())
+}
+
+// InterceptorFunc adapts a function to the Interceptor interface.
+type InterceptorFunc func(m *Message, next func())
+
+func (f InterceptorFunc) Intercept(m *Message, next func()) {
+	f(m, next)
+}
+
+// Intercept installs ic to intercept all messages arriving at agent a.
+// Calling the returned function removes ic.
+func (e *Engine) Intercept(a Agent, ic Interceptor) (remove func()) {
+	if e.interceptors == nil {
+		e.interceptors = map[Agent]*listeners[Interceptor]{}
+	}
+	ls, ok := e.interceptors[a]
+	if !ok {
+		ls = &listeners[Interceptor]{}
+		e.interceptors[a] = ls
+	}
+	return ls.add(ic)
+}
+
+// receive passes message m through agent a's interceptors to a's Receive
+// method.
+func (e *Engine) receive(a Agent, m *Message) {
+	var chain []Interceptor
+	if e != nil {
+		if ls, ok := e.interceptors[a]; ok {
+			for _, ic := range *ls {
+				chain = append(chain, *ic)
+			}
+		}
+	}
+	if ic, ok := a.(Interceptor); ok {
+		chain = append(chain, ic)
+	}
+
+	var next func()
+	next = func() {
+		if len(chain) == 0 {
+			a.Receive(m)
+			return
+		}
+		ic := chain[0]
+		chain = chain[1:]
+		ic.Intercept(m, next)
+	}
+	next()
+}
+
+// Reject returns the message to its sender with the given reason: the
+// message retraces its path toward the sender (as a DownMsg) with
+// Rejection returning reason.  Reject is usually called by an Interceptor
+// instead of passing the message on.  Agents on the path back should pass
+// rejected messages on unchanged.  Rejecting a message that is already at
+// its sender only sets its reason.
+func (m *Message) Reject(reason string) {
+	if reason == "" {
+		reason = "rejected"
+	}
+	m.rejection = reason
+	if m.trace != nil {
+		m.trace.Rejection = reason
+	}
+	if len(m.pathStack) > 1 {
+		m.Dir = DownMsg
+		m.SendOn()
+	}
+}
+
+// Rejection returns the reason the message was rejected (see Reject) or the
+// empty string if it wasn't.
+func (m *Message) Rejection() string {
+	return m.rejection
+}
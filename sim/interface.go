@@ -2,6 +2,7 @@ package sim
 
 import (
 	"fmt"
+	"github.com/rwcarlsen/goclus/trans"
 )
 
 type Agent interface {
@@ -28,6 +29,7 @@ type Agenty struct {
 	id     int
 	name   string
 	parent Agent
+	eng    *Engine
 }
 
 // Id returns the value passed via SetId or the empty string if it hasn't
@@ -70,6 +72,40 @@ func (a *Agenty) SetParent(p Agent) {
 // Receive does nothing
 func (a *Agenty) Receive(*Message) {}
 
+// TransNotifier returns the transaction notifier of the engine the agent is
+// registered with (or nil), so that transactions the agent supplies or
+// requests are reported to the engine's transaction listeners even if they
+// aren't sent in a message.
+func (a *Agenty) TransNotifier() *trans.Notifier {
+	if a.eng == nil {
+		return nil
+	}
+	return &a.eng.transLis
+}
+
+func (a *Agenty) engine() *Engine {
+	return a.eng
+}
+
+func (a *Agenty) setEngine(e *Engine) {
+	a.eng = e
+}
+
+// engineHolder is implemented by agents that embed Agenty.
+type engineHolder interface {
+	engine() *Engine
+	setEngine(*Engine)
+}
+
+// engineOf returns the engine agent a is registered with or nil if a is
+// not registered or does not embed Agenty.
+func engineOf(a Agent) *Engine {
+	if h, ok := a.(engineHolder); ok {
+		return h.engine()
+	}
+	return nil
+}
+
 type Starter interface {
 	Start(*Engine)
 }
@@ -89,3 +125,17 @@ type Tocker interface {
 type Resolver interface {
 	Resolve()
 }
+
+// Decayer is implemented by agents that need to update their state (e.g.
+// radioactive decay or depreciation) at the beginning of each time step
+// before any agents tick.
+type Decayer interface {
+	Decay()
+}
+
+// Reporter is implemented by agents that need to observe (e.g. for
+// accounting) the state of the simulation at the end of each time step
+// after all agents have tocked.
+type Reporter interface {
+	Report()
+}
@@ -4,40 +4,119 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 type ProtoInfo struct {
+	// Base is the id of the prototype this prototype inherits from.  The
+	// base's ImportPath is used unless overridden, and Config values
+	// override the base's values key by key.
+	Base       string
 	ImportPath string
 	Config     map[string]interface{}
 }
 
 type AgentInfo struct {
-	Name       string
-	ProtoId    string
+	Name    string
+	ProtoId string
+	// ParentName is the name of the agent's parent.  It may only be set on
+	// top-level agents; the parent of each of an agent's Children is that
+	// agent.
 	ParentName string
 	IsService  bool
+	// Start is the time after the beginning of the simulation at which the
+	// agent is deployed.
+	Start time.Duration
+	// Lifetime is the time the agent remains deployed before being
+	// decommissioned.  Zero means the agent is never decommissioned.
+	Lifetime time.Duration
+	// Children are agents that have this agent as their parent.
+	Children []*AgentInfo
+	// Count is the number of copies of the agent (each with copies of its
+	// children) to create.  If Count is greater than one, copies are named
+	// Name-1, Name-2, etc. and each copy's descendants are given the same
+	// suffix as the copy (e.g. the child "fac" of copy "inst-2" is named
+	// "fac-2", and its third copy "fac-2-3" if fac also has a Count).
+	Count int
+	path  string // json path of the declaration the agent was expanded from
 }
 
 type Loader struct {
+	// Include lists input files (relative to the including file) whose
+	// prototypes and agents are added to those of the including file.
+	Include    []string
 	Prototypes map[string]*ProtoInfo
 	Agents     []*AgentInfo
 	Engine     *Engine
-	agentLib   map[string]reflect.Type
-	protos     map[string]interface{}
-	imports    map[string]string
+	// Sweep optionally declares a parameter sweep over prototype
+	// configuration values (see SweepPoints).  Build does not expand it;
+	// each sweep point is built from its own Loader.
+	Sweep    []*SweepParam
+	agentLib typeRegistry
+	protos   map[string]interface{}
+	imports  map[string]string
+	protoOf  map[Agent]string // prototype id of agents created from prototypes
+	deploys  map[string]*deployment
 }
 
-func (l *Loader) Register(a interface{}) {
-	if l.agentLib == nil {
-		l.agentLib = map[string]reflect.Type{}
+// deployment is the scheduled deployment of an input agent.
+type deployment struct {
+	a  Agent
+	ev *Event
+}
+
+// Register makes the agent type of a available to this loader only (in
+// addition to the types registered with the package-level Register) under
+// its import path and the given aliases.
+func (l *Loader) Register(a interface{}, aliases ...string) {
+	l.agentLib.add(a, aliases)
+}
+
+// agentType returns the agent type registered with the loader or package
+// under name (an import path or alias) and its import path.
+func (l *Loader) agentType(name string) (reflect.Type, string, bool) {
+	if t, path, ok := l.agentLib.lookup(name); ok {
+		return t, path, true
+	}
+	return registry.lookup(name)
+}
+
+// AgentTypes returns the import paths of all agent types registered with
+// the loader or package in sorted order.
+func (l *Loader) AgentTypes() []string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, path := range append(l.agentLib.paths(), registry.paths()...) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
 	}
-	v := reflect.Indirect(reflect.ValueOf(a))
-	t := v.Type()
-	name := t.PkgPath() + "." + t.Name()
-	l.agentLib[name] = t
+	sort.Strings(paths)
+	return paths
+}
+
+// Aliases returns the sorted aliases of the agent type registered under
+// importPath.
+func (l *Loader) Aliases(importPath string) []string {
+	aliases := append(l.agentLib.aliasesOf(importPath), registry.aliasesOf(importPath)...)
+	sort.Strings(aliases)
+	return aliases
+}
+
+// ConfigFields returns the fields of the agent type registered under
+// importPath (or an alias) that can be set via prototype Config entries
+// (i.e. exported, json-decodable fields).
+func (l *Loader) ConfigFields(importPath string) ([]reflect.StructField, error) {
+	tp, _, ok := l.agentType(importPath)
+	if !ok {
+		return nil, errors.New("loader: no registered agent for import path '" + importPath + "'")
+	}
+
+	return decodableFields(tp), nil
 }
 
 func (l *Loader) NewAgent(importPath string, parent Agent) Agent {
@@ -49,7 +128,7 @@ func (l *Loader) NewAgent(importPath string, parent Agent) Agent {
 }
 
 func (l *Loader) newPrototype(importPath string) Agent {
-	if tp, ok := l.agentLib[importPath]; ok {
+	if tp, _, ok := l.agentType(importPath); ok {
 		if a, ok := reflect.New(tp).Interface().(Agent); !ok {
 			panic("loader: Agent '" + importPath + "' does not implement required sim.Agent methods")
 		} else {
@@ -64,71 +143,263 @@ func (l *Loader) NewAgentFromProto(protoId string, parent Agent) Agent {
 	a := l.NewAgent(importPath, parent)
 	data, _ := json.Marshal(l.protos[protoId])
 	json.Unmarshal(data, a)
+
+	if l.protoOf == nil {
+		l.protoOf = map[Agent]string{}
+	}
+	l.protoOf[a] = protoId
 	return a
 }
 
+// LoadSim decodes the input file fname and builds the simulation it
+// describes (see Decode and Build).
 func (l *Loader) LoadSim(fname string) error {
-	// load input file
-	data, err := ioutil.ReadFile(fname)
-	if err != nil {
+	if err := l.Decode(fname); err != nil {
 		return err
 	}
+	return l.Build()
+}
 
-	err = json.Unmarshal(data, l)
-	if err != nil {
-		return prettyParseError(string(data), err)
+// Decode reads the input file fname into the loader without creating any
+// prototypes or agents.  The decoded input (e.g. l.Engine and
+// l.Prototypes) may be modified before calling Build.  The file's format is
+// chosen by its extension (see FormatOf).
+//
+// Durations and times (e.g. in l.Engine and prototype configurations) may
+// be given as numbers of nanoseconds and RFC 3339 strings or as strings
+// accepted by ParseDuration and ParseTime.
+func (l *Loader) Decode(fname string) error {
+	return l.DecodeFormat(fname, FormatOf(fname))
+}
+
+// DecodeFormat is like Decode, but reads fname in the given format (one of
+// "json", "yaml" or "toml") regardless of its extension.  Included files
+// are always read in the format implied by their extension.
+func (l *Loader) DecodeFormat(fname, format string) error {
+	if err := l.decodeFile(fname, format, &includes{seen: map[string]bool{}}); err != nil {
+		return err
 	}
+	if l.Engine == nil {
+		l.Engine = &Engine{}
+	}
+	return nil
+}
+
+// Build creates and configures the decoded prototypes and creates, deploys
+// and schedules the decoded agents.  It fails with InputErrors if the
+// decoded input does not pass Validate.
+func (l *Loader) Build() error {
+	if err := l.Validate(); err != nil {
+		return err
+	} else if err := l.buildProtos(); err != nil {
+		return err
+	}
+	l.Engine.Load = l
+	l.Engine.begin()
+	l.scheduleAgents(l.expandAgents(nil), map[string]Agent{})
+	return nil
+}
+
+// SetConfig sets the decoded configuration value of field for the prototype
+// protoId (and prototypes inheriting from it that don't override field).  It
+// must be called between Decode and Build.
+func (l *Loader) SetConfig(protoId, field string, v interface{}) error {
+	info, ok := l.Prototypes[protoId]
+	if !ok {
+		return errors.New("loader: no prototype with id '" + protoId + "'")
+	}
+	if info.Config == nil {
+		info.Config = map[string]interface{}{}
+	}
+	// replace the value of field however its key is cased
+	if key, ok := configKey(info.Config, field); ok {
+		delete(info.Config, key)
+	}
+	info.Config[field] = v
+	return nil
+}
 
+// buildProtos creates and configures the decoded prototypes.
+func (l *Loader) buildProtos() error {
 	// create prototypes
 	l.protos = map[string]interface{}{}
 	l.imports = map[string]string{}
-	for protoId, info := range l.Prototypes {
-		p := l.newPrototype(info.ImportPath)
-		l.protos[protoId] = p
-		l.imports[protoId] = info.ImportPath
+	infos := map[string]*ProtoInfo{}
+	for protoId := range l.Prototypes {
+		info, _, err := l.resolveProto(protoId)
+		if err != nil {
+			return err
+		}
+		infos[protoId] = info
+		_, path, _ := l.agentType(info.ImportPath)
+		l.protos[protoId] = l.newPrototype(path)
+		l.imports[protoId] = path
 	}
 
 	// configure prototypes
 	for id, p := range l.protos {
-		if l.Prototypes[id].Config == nil {
-			continue
+		path := fmt.Sprintf("Prototypes[%q].Config", id)
+		if err := decodeJSON(path, infos[id].Config, p); err != nil {
+			return prettyMarshalErr(id, nil, err)
 		}
-		data, _ := json.Marshal(l.Prototypes[id].Config)
-		err := json.Unmarshal(data, p)
-		if err != nil {
-			return prettyMarshalErr(id, data, err)
+	}
+
+	return nil
+}
+
+// resolveProto returns the effective info of prototype id, with the
+// ImportPath and Config values inherited from its chain of bases and the
+// defaults of its agent type's schema.  from holds the id of the prototype
+// that set each Config key (or "" for defaults).
+func (l *Loader) resolveProto(id string) (info *ProtoInfo, from map[string]string, err error) {
+	chain := []string{}
+	for cur := id; cur != ""; cur = l.Prototypes[cur].Base {
+		for i, c := range chain {
+			if c == cur {
+				cycle := strings.Join(append(chain[i:], cur), " -> ")
+				return nil, nil, errors.New("loader: prototype inheritance cycle " + cycle)
+			}
+		}
+		if l.Prototypes[cur] == nil {
+			return nil, nil, errors.New("loader: no prototype with id '" + cur + "'")
+		}
+		chain = append(chain, cur)
+	}
+
+	info = &ProtoInfo{Base: l.Prototypes[id].Base, Config: map[string]interface{}{}}
+	from = map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		p := l.Prototypes[chain[i]]
+		if p.ImportPath != "" {
+			info.ImportPath = p.ImportPath
+		}
+		for _, key := range sortedKeys(p.Config) {
+			// keys match fields case-insensitively
+			for k := range info.Config {
+				if strings.EqualFold(k, key) {
+					delete(info.Config, k)
+					delete(from, k)
+				}
+			}
+			info.Config[key] = p.Config[key]
+			from[key] = chain[i]
+		}
+	}
+
+	if tp, _, ok := l.agentType(info.ImportPath); ok {
+		for _, f := range schemaOf(tp) {
+			if _, ok := configKey(info.Config, f.Name); !ok && f.Default != "" {
+				info.Config[f.Name] = f.defaultValue()
+				from[f.Name] = ""
+			}
+		}
+	}
+	return info, from, nil
+}
+
+// configKey returns the key in config that sets the field with json name
+// (matched case-insensitively as by encoding/json).
+func configKey(config map[string]interface{}, name string) (string, bool) {
+	for key := range config {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// expandAgents returns the agents declared in l.Agents and their children,
+// with Counts expanded into individually named copies.  Every returned
+// agent (parents before their children) has no Children and, if nested,
+// its parent's name as ParentName.  Problems with the declarations are
+// reported to fail if it is not nil.
+func (l *Loader) expandAgents(fail func(path, format string, args ...interface{})) []*AgentInfo {
+	if fail == nil {
+		fail = func(string, string, ...interface{}) {}
+	}
+
+	var agents []*AgentInfo
+	var expand func(info *AgentInfo, path, parent, suffix string)
+	expand = func(info *AgentInfo, path, parent, suffix string) {
+		if info == nil {
+			fail(path, "missing")
+			return
+		} else if info.Count < 0 {
+			fail(path+".Count", "must not be negative")
+		} else if parent != "" && info.ParentName != "" {
+			fail(path+".ParentName", "not allowed on nested agents")
+		}
+
+		for i := 0; i < max(info.Count, 1); i++ {
+			s := suffix
+			if info.Count > 1 {
+				s += fmt.Sprintf("-%v", i+1)
+			}
+			a := *info
+			a.Name, a.Children, a.path = info.Name+s, nil, path
+			if parent != "" {
+				a.ParentName = parent
+			}
+			agents = append(agents, &a)
+
+			for j, c := range info.Children {
+				expand(c, fmt.Sprintf("%v.Children[%v]", path, j), a.Name, s)
+			}
 		}
 	}
+	for i, info := range l.Agents {
+		expand(info, fmt.Sprintf("Agents[%v]", i), "", "")
+	}
+	return agents
+}
 
+// scheduleAgents creates agents from infos and deploys or schedules their
+// deployment and decommissioning.  Parent names are resolved among the new
+// agents and the agents in byName, to which the new agents are added.
+func (l *Loader) scheduleAgents(infos []*AgentInfo, byName map[string]Agent) {
 	// create agents from prototypes
 	agents := []Agent{}
-	agentMap := map[string]Agent{}
-	for _, info := range l.Agents {
+	for _, info := range infos {
 		a := l.NewAgentFromProto(info.ProtoId, nil)
-		agentMap[info.Name] = a
+		a.SetName(info.Name)
+		byName[info.Name] = a
 		agents = append(agents, a)
+	}
 
-		a.SetName(info.Name)
-		l.Engine.RegisterAll(a)
+	// set parents
+	for i, info := range infos {
+		if par, ok := byName[info.ParentName]; ok {
+			agents[i].SetParent(par)
+		}
+	}
 
-		// register as service
-		if info.IsService {
-			if err := l.Engine.RegisterService(a); err != nil {
-				panic("loader: " + err.Error())
+	// schedule deployment
+	e := l.Engine
+	start := e.Start
+	for i, info := range infos {
+		a, info := agents[i], info
+		deploy := func() {
+			// services are available to deploy listeners
+			if info.IsService {
+				if err := e.RegisterService(a); err != nil {
+					panic("loader: " + err.Error())
+				}
 			}
+			e.RegisterAll(a)
 		}
-	}
 
-	for i, info := range l.Agents {
-		// set parents
-		a := agents[i]
-		if par, ok := agentMap[info.ParentName]; ok {
-			a.SetParent(par)
+		if info.Start <= 0 {
+			deploy()
+		} else {
+			if l.deploys == nil {
+				l.deploys = map[string]*deployment{}
+			}
+			l.deploys[info.Name] = &deployment{a, e.Schedule(start.Add(info.Start), deploy)}
+		}
+		if info.Lifetime > 0 {
+			e.DecommissionAt(start.Add(info.Start+info.Lifetime), a)
 		}
 	}
-
-	l.Engine.Load = l
-	return nil
 }
 
 func prettyParseError(js string, err error) error {
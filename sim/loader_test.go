@@ -0,0 +1,351 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rwcarlsen/goclus/util/assert"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepPoints(t *testing.T) {
+	l := &Loader{
+		Prototypes: map[string]*ProtoInfo{"src": {}, "snk": {}},
+		Sweep: []*SweepParam{
+			{Proto: "src", Field: "CreateRate", From: 1, To: 10, Steps: 4},
+			{Proto: "snk", Field: "InUnits", Values: []interface{}{"kg", "gal"}},
+		},
+	}
+	points, err := l.SweepPoints()
+	assert.NoErr(t, err).Fatal()
+	assert.Eq(t, len(points), 8).Fatal()
+
+	assert.Eq(t, points[0][0].Value, 1.0)
+	assert.Eq(t, points[0][1].Value, "kg")
+	assert.Eq(t, points[1][0].Value, 1.0)
+	assert.Eq(t, points[1][1].Value, "gal")
+	assert.Eq(t, points[7][0].Value, 10.0)
+	assert.Eq(t, points[7][0].String(), "src.CreateRate=10")
+
+	l.Sweep = append(l.Sweep, &SweepParam{Proto: "nope", Field: "X", Steps: 1})
+	_, err = l.SweepPoints()
+	assert.Err(t, err)
+}
+
+type trader struct {
+	Agenty
+	Commod string
+	Size   float64
+}
+
+func (t *trader) Commods() []string { return []string{t.Commod} }
+
+func TestValidate(t *testing.T) {
+	const tp = "github.com/rwcarlsen/goclus/sim.trader"
+	l := &Loader{
+		Engine: &Engine{Duration: time.Hour},
+		Prototypes: map[string]*ProtoInfo{
+			"tr":  {ImportPath: tp, Config: map[string]interface{}{"Commod": "milk", "Size": "big", "Bogus": 1}},
+			"bad": {ImportPath: "nope.Nope"},
+		},
+		Agents: []*AgentInfo{
+			{Name: "a", ProtoId: "tr", ParentName: "b"},
+			{Name: "b", ProtoId: "tr", ParentName: "a"},
+			{Name: "b", ProtoId: "missing"},
+			{Name: "c", ProtoId: "tr", ParentName: "nobody"},
+		},
+	}
+	l.Register(trader{})
+
+	err := l.Validate()
+	var errs InputErrors
+	assert.Eq(t, errors.As(err, &errs), true).Fatal()
+
+	paths := map[string]bool{}
+	for _, e := range errs {
+		paths[e.Path] = true
+	}
+	for _, path := range []string{
+		"Engine.Step",
+		`Prototypes["bad"].ImportPath`,
+		`Prototypes["tr"].Config.Bogus`,
+		`Prototypes["tr"].Config.Size`,
+		`Prototypes["tr"]`,
+		"Agents[0].ParentName",
+		"Agents[2].Name",
+		"Agents[2].ProtoId",
+		"Agents[3].ParentName",
+	} {
+		assert.Eq(t, paths[path], true)
+	}
+	assert.Eq(t, len(errs), 9)
+
+	// fixing the problems makes the input valid
+	l.Engine.Step = time.Minute
+	delete(l.Prototypes, "bad")
+	l.Prototypes["tr"].Config = map[string]interface{}{"Commod": "a"}
+	l.Agents = []*AgentInfo{{Name: "a", ProtoId: "tr", IsService: true}, {Name: "b", ProtoId: "tr", ParentName: "a"}}
+	assert.NoErr(t, l.Validate())
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"50y":   50 * Year,
+		"18mo":  18 * Month,
+		"1y6mo": 18 * Month,
+		"30d":   30 * Day,
+		"1.5h":  90 * time.Minute,
+		"-2w":   -14 * Day,
+		"0":     0,
+	} {
+		d, err := ParseDuration(s)
+		assert.NoErr(t, err)
+		assert.Eq(t, d, want)
+	}
+	for _, s := range []string{"", "y", "5", "5x", "1000y"} {
+		_, err := ParseDuration(s)
+		assert.Err(t, err)
+	}
+}
+
+func TestDecodeFormats(t *testing.T) {
+	inputs := map[string]string{
+		"in.json": `{
+			"Engine": {"Start": "2025-01-01", "Duration": "2y", "Step": "1mo"},
+			"Prototypes": {"p": {"ImportPath": "x.Y", "Config": {"Size": 5, "Commod": "milk"}}},
+			"Agents": [{"Name": "a", "ProtoId": "p", "Start": "1y"}, {"Name": "b", "ProtoId": "p", "ParentName": "a"}]
+		}`,
+		"in.yaml": `
+# comments are allowed
+Engine: {Start: 2025-01-01, Duration: 2y, Step: 1mo}
+Prototypes:
+  p:
+    ImportPath: x.Y
+    Config: {Size: 5, Commod: milk}
+Agents:
+  - {Name: a, ProtoId: p, Start: 1y}
+  - Name: b
+    ProtoId: p
+    ParentName: a
+`,
+		"in.toml": `
+# comments are allowed
+[Engine]
+Start = 2025-01-01
+Duration = "2y"
+Step = "1mo"
+
+[Prototypes.p]
+ImportPath = "x.Y"
+Config = {Size = 5, Commod = "milk"}
+
+[[Agents]]
+Name = "a"
+ProtoId = "p"
+Start = "1y"
+
+[[Agents]]
+Name = "b"
+ProtoId = "p"
+ParentName = "a"
+`,
+	}
+
+	dir := t.TempDir()
+	var want *Loader
+	for _, name := range []string{"in.json", "in.yaml", "in.toml"} {
+		fname := filepath.Join(dir, name)
+		err := os.WriteFile(fname, []byte(inputs[name]), 0644)
+		assert.NoErr(t, err).Fatal()
+
+		l := &Loader{}
+		assert.NoErr(t, l.Decode(fname)).Fatal()
+		if want == nil {
+			want = l
+			assert.Eq(t, l.Engine.Step, Month)
+			assert.Eq(t, l.Agents[0].Start, Year)
+			continue
+		}
+		assert.Eq(t, reflect.DeepEqual(l.Engine, want.Engine), true)
+		assert.Eq(t, reflect.DeepEqual(l.Prototypes, want.Prototypes), true)
+		assert.Eq(t, reflect.DeepEqual(l.Agents, want.Agents), true)
+	}
+
+	fname := filepath.Join(dir, "bad.yaml")
+	os.WriteFile(fname, []byte("Engine:\n  Step: 1mo\n Duration: 2y\n"), 0644)
+	err := (&Loader{}).Decode(fname)
+	assert.Err(t, err)
+	assert.Eq(t, strings.Contains(fmt.Sprint(err), "line 2"), true)
+}
+
+func TestIncludeAndInherit(t *testing.T) {
+	const tp = "github.com/rwcarlsen/goclus/sim.trader"
+	dir := t.TempDir()
+	files := map[string]string{
+		"lib/base.yaml": "Prototypes:\n  base: {ImportPath: " + tp + ", Config: {Commod: milk, Size: 1}}\n",
+		"lib/facs.yaml": "Include: [base.yaml]\nPrototypes:\n  big: {Base: base, Config: {size: 10}}\n",
+		"in.yaml": `
+Include: [lib/facs.yaml, lib/base.yaml]
+Engine: {Duration: 1y, Step: 1mo}
+Prototypes:
+  bigger: {Base: big, Config: {Commod: cream}}
+Agents:
+  - {Name: milk, ProtoId: base, IsService: true}
+  - {Name: cream, ProtoId: bigger, IsService: true}
+`,
+		"cycle1.yaml": "Include: [cycle2.yaml]\n",
+		"cycle2.yaml": "Include: [cycle1.yaml]\n",
+	}
+	for name, data := range files {
+		fname := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fname), 0755)
+		assert.NoErr(t, os.WriteFile(fname, []byte(data), 0644)).Fatal()
+	}
+
+	l := &Loader{}
+	l.Register(trader{})
+	assert.NoErr(t, l.Decode(filepath.Join(dir, "in.yaml"))).Fatal()
+	assert.Eq(t, len(l.Prototypes), 3)
+	assert.NoErr(t, l.Validate())
+
+	info, _, err := l.resolveProto("bigger")
+	assert.NoErr(t, err).Fatal()
+	assert.Eq(t, info.ImportPath, tp)
+	assert.Eq(t, len(info.Config), 2)
+	assert.Eq(t, info.Config["size"], 10.0)
+	assert.Eq(t, info.Config["Commod"], "cream")
+
+	assert.NoErr(t, l.buildProtos()).Fatal()
+	p := l.protos["bigger"].(*trader)
+	assert.Eq(t, p.Size, 10.0)
+	assert.Eq(t, p.Commod, "cream")
+
+	l.Prototypes["base"].Base = "bigger"
+	err = l.Validate()
+	assert.Err(t, err)
+	assert.Eq(t, strings.Contains(fmt.Sprint(err), "inheritance cycle"), true)
+
+	err = (&Loader{}).Decode(filepath.Join(dir, "cycle1.yaml"))
+	assert.Eq(t, strings.Contains(fmt.Sprint(err), "include cycle"), true)
+}
+
+func TestExpandAgents(t *testing.T) {
+	l := &Loader{Agents: []*AgentInfo{
+		{Name: "region", Children: []*AgentInfo{
+			{Name: "inst", Count: 2, Children: []*AgentInfo{
+				{Name: "fac", Count: 2},
+				{Name: "bad", ParentName: "region"},
+			}},
+		}},
+	}}
+
+	var errs []string
+	agents := l.expandAgents(func(path, format string, args ...interface{}) {
+		errs = append(errs, path)
+	})
+	names := []string{}
+	for _, a := range agents {
+		names = append(names, a.Name+"<"+a.ParentName)
+	}
+	assert.Eq(t, strings.Join(names, " "), "region< inst-1<region fac-1-1<inst-1 fac-1-2<inst-1 bad-1<inst-1 "+
+		"inst-2<region fac-2-1<inst-2 fac-2-2<inst-2 bad-2<inst-2")
+	assert.Eq(t, agents[2].path, "Agents[0].Children[0].Children[0]")
+	assert.Eq(t, len(errs), 2)
+	assert.Eq(t, errs[0], "Agents[0].Children[0].Children[1].ParentName")
+}
+
+func TestConfig(t *testing.T) {
+	eng := &Engine{Duration: Year, Step: Month, Seed: 3}
+	par := &trader{Commod: "milk"}
+	par.SetName("par")
+	child := &trader{Size: 2}
+	child.SetName("child")
+	child.SetParent(par)
+	eng.RegisterService(par)
+	eng.RegisterAll(par)
+	eng.RegisterAll(child)
+
+	cfg, err := eng.Config()
+	assert.NoErr(t, err).Fatal()
+	assert.Eq(t, cfg.Seed, int64(3))
+	assert.Eq(t, len(cfg.Agents), 2).Fatal()
+	assert.Eq(t, cfg.Agents[0].IsService, true)
+	assert.Eq(t, cfg.Agents[1].ParentId, par.Id())
+	assert.Eq(t, cfg.Agents[1].Type, "github.com/rwcarlsen/goclus/sim.trader")
+	assert.Eq(t, string(cfg.Agents[1].Config), `{"Commod":"","Size":2}`)
+}
+
+func TestSetConfig(t *testing.T) {
+	l := &Loader{Prototypes: map[string]*ProtoInfo{
+		"p": {ImportPath: "github.com/rwcarlsen/goclus/sim.trader", Config: map[string]interface{}{"size": 1, "Commod": "milk"}},
+	}}
+	l.Register(trader{})
+	assert.NoErr(t, l.SetConfig("p", "Size", 10.0))
+	assert.Err(t, l.SetConfig("q", "Size", 10.0))
+
+	// the value replaces the one set under a differently cased key
+	info, _, err := l.resolveProto("p")
+	assert.NoErr(t, err).Fatal()
+	assert.Eq(t, len(info.Config), 2)
+	assert.Eq(t, info.Config["Size"], 10.0)
+	assert.NoErr(t, l.buildProtos()).Fatal()
+	assert.Eq(t, l.protos["p"].(*trader).Size, 10.0)
+}
+
+func TestRegisterAliases(t *testing.T) {
+	l := &Loader{}
+	l.Register(trader{}, "tr")
+	_, path, ok := l.agentType("tr")
+	assert.Eq(t, ok, true)
+	assert.Eq(t, path, "github.com/rwcarlsen/goclus/sim.trader")
+	assert.Eq(t, strings.Join(l.Aliases(path), ","), "tr")
+	fields, err := l.ConfigFields("tr")
+	assert.NoErr(t, err)
+	assert.Eq(t, len(fields), 2)
+
+	defer func() { assert.Ne(t, recover(), nil) }()
+	l.Register(recorder{}, "tr")
+}
+
+type tagged struct {
+	Agenty
+	Label string        `required:"true"`
+	Size  float64       `units:"kg" min:"0" max:"10" default:"5"`
+	Every time.Duration `min:"1d" default:"1mo"`
+}
+
+func TestSchema(t *testing.T) {
+	const tp = "github.com/rwcarlsen/goclus/sim.tagged"
+	l := &Loader{
+		Engine: &Engine{Duration: Year, Step: Month},
+		Prototypes: map[string]*ProtoInfo{
+			"ok":  {ImportPath: tp, Config: map[string]interface{}{"label": "x"}},
+			"bad": {ImportPath: tp, Config: map[string]interface{}{"Size": 11, "Every": "1h"}},
+		},
+	}
+	l.Register(tagged{})
+
+	schema, err := l.Schema(tp)
+	assert.NoErr(t, err).Fatal()
+	assert.Eq(t, len(schema), 3).Fatal()
+	assert.Eq(t, schema[1].Units, "kg")
+	assert.Eq(t, schema[1].Range(), "[0, 10]")
+
+	var errs InputErrors
+	assert.Eq(t, errors.As(l.Validate(), &errs), true).Fatal()
+	paths := []string{}
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	assert.Eq(t, strings.Join(paths, " "), `Prototypes["bad"].Config Prototypes["bad"].Config.Size Prototypes["bad"].Config.Every`)
+
+	delete(l.Prototypes, "bad")
+	assert.NoErr(t, l.buildProtos()).Fatal()
+	p := l.protos["ok"].(*tagged)
+	assert.Eq(t, p.Size, 5.0)
+	assert.Eq(t, p.Every, Month)
+}
@@ -0,0 +1,92 @@
+package sim
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Logger returns a logger whose records are tagged with agent a's name and
+// id and the simulation time at which each record is made.  Agents should
+// obtain their logger in Start.  If a is nil, the engine's own logger is
+// returned.  The engine's logger is created when the first agent is
+// registered or the simulation begins, whichever comes first.
+//
+// Records are written as configured by the engine's LogLevel, LogFile and
+// LogFormat fields unless a handler has been set via SetLogHandler.
+func (e *Engine) Logger(a Agent) *slog.Logger {
+	e.initLog()
+	if a == nil {
+		return e.log
+	}
+	return e.log.With("agent", a.Name(), "id", a.Id())
+}
+
+// SetLogHandler directs all engine and agent log records to h.  Loggers
+// previously returned by Logger are unaffected.
+func (e *Engine) SetLogHandler(h slog.Handler) {
+	e.log = slog.New(&simTimeHandler{Handler: h, eng: e})
+}
+
+// initLog creates the engine's logger unless it already exists.  It must
+// not be called concurrently with Logger - i.e. only on the engine's
+// goroutine outside of parallel Tick phases.
+func (e *Engine) initLog() {
+	if e.log == nil {
+		e.SetLogHandler(e.newLogHandler())
+	}
+}
+
+// newLogHandler creates the handler configured by the engine's LogLevel,
+// LogFile and LogFormat fields.  If LogFile cannot be created, records are
+// written to stderr instead.
+func (e *Engine) newLogHandler() slog.Handler {
+	var w io.Writer = os.Stderr
+	var openErr error
+	if e.LogFile != "" {
+		f, err := os.Create(e.OutPath(e.LogFile))
+		if err == nil {
+			e.logFile, w = f, f
+		}
+		openErr = err
+	}
+
+	opts := &slog.HandlerOptions{Level: e.LogLevel}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if e.LogFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+
+	if openErr != nil {
+		slog.New(h).Error("cannot open log file", "err", openErr)
+	}
+	return h
+}
+
+// closeLog closes the engine's log file if it has one.
+func (e *Engine) closeLog() {
+	if e.logFile != nil {
+		e.logFile.Close()
+		e.logFile = nil
+	}
+}
+
+// simTimeHandler adds the engine's current simulation time to every record.
+type simTimeHandler struct {
+	slog.Handler
+	eng *Engine
+}
+
+func (h *simTimeHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(slog.Time("simtime", h.eng.Time()))
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *simTimeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &simTimeHandler{Handler: h.Handler.WithAttrs(attrs), eng: h.eng}
+}
+
+func (h *simTimeHandler) WithGroup(name string) slog.Handler {
+	return &simTimeHandler{Handler: h.Handler.WithGroup(name), eng: h.eng}
+}
@@ -4,8 +4,6 @@ import (
 	"github.com/rwcarlsen/goclus/trans"
 )
 
-var listeners []MsgListener
-
 type msgDir int
 
 const (
@@ -17,6 +15,13 @@ const (
 	DownMsg
 )
 
+func (d msgDir) String() string {
+	if d == DownMsg {
+		return "down"
+	}
+	return "up"
+}
+
 type MsgGroup []*Message
 
 // MsgListener is implemented by entities that desire to receive notifications
@@ -25,19 +30,49 @@ type MsgListener interface {
 	MsgNotify(*Message)
 }
 
-// ListenAll adds l to a global list of agents that receive notifications
-// for every message passed between any two agents (usually used by "special"
-// agents e.g. book-keeper, etc.).
+// ListenMsgs adds l to the engine's list of agents that receive
+// notifications for every message passed between any two of the engine's
+// agents (usually used by "special" agents e.g. book-keeper, etc.).
 // These notifications are sent every time a message SendOn method is
 // called - before the receiver actually receives the message. Simulation
-// execution continues only after l's MsgNotify method returns.
-func ListenAllMsg(l MsgListener) {
-	listeners = append(listeners, l)
+// execution continues only after l's MsgNotify method returns.  Calling the
+// returned function removes l.
+func (e *Engine) ListenMsgs(l MsgListener) (unsubscribe func()) {
+	return e.msgLis.add(l)
 }
 
-func notifyListeners(m *Message) {
-	for _, l := range listeners {
-		l.MsgNotify(m)
+// ListenTrans adds l to the engine's list of agents that receive
+// notifications for every approved transaction sent in a message between
+// any two of the engine's agents.  Calling the returned function removes l.
+func (e *Engine) ListenTrans(l trans.Listener) (unsubscribe func()) {
+	return e.transLis.Listen(l)
+}
+
+func (e *Engine) notifyMsg(m *Message) {
+	if m.Trans != nil {
+		m.Trans.SetNotifier(&e.transLis)
+	}
+	for _, l := range e.msgLis {
+		(*l).MsgNotify(m)
+	}
+}
+
+// listeners is a list of listeners that can safely be added to and removed
+// from while being iterated over.
+type listeners[T any] []*T
+
+// add appends l to the list.  Calling the returned function removes l.
+func (ls *listeners[T]) add(l T) (remove func()) {
+	p := &l
+	*ls = append(*ls, p)
+	return func() {
+		var rest listeners[T]
+		for _, other := range *ls {
+			if other != p {
+				rest = append(rest, other)
+			}
+		}
+		*ls = rest
 	}
 }
 
@@ -63,10 +98,17 @@ type Message struct {
 	Payload   interface{}
 	PrevOwner Agent
 	Owner     Agent
+	eng       *Engine
 	sender    Agent
 	receiver  Agent
 	pathStack []Agent
 	hasDest   bool
+	id        int
+	cloneOf   int
+	trace     *MsgTrace
+	to        *Addr      // the group an addressed message is sent to
+	clones    []*Message // the clones an addressed message was fanned out as
+	rejection string
 }
 
 // New creates a new message with receiver as the intended final destination. The
@@ -75,8 +117,13 @@ func NewMsg(sender, receiver Agent) *Message {
 	if receiver == nil {
 		panic("msg: cannot have nil message receiver")
 	}
+	eng := engineOf(sender)
+	if eng == nil {
+		eng = engineOf(receiver)
+	}
 	return &Message{
 		Dir:       UpMsg,
+		eng:       eng,
 		sender:    sender,
 		receiver:  receiver,
 		Owner:     sender,
@@ -89,16 +136,34 @@ func (m *Message) Sender() Agent {
 	return m.sender
 }
 
-// Receiver returns the original intended recipient of this message.
+// Receiver returns the original intended recipient of this message or nil
+// if it is addressed to a group of agents (see NewMsgTo).
 func (m *Message) Receiver() Agent {
 	return m.receiver
 }
 
+// Id returns the message's id, unique among the messages of its engine.
+// Messages are assigned ids in the order they are first sent; Id returns
+// zero for messages that haven't been sent.
+func (m *Message) Id() int {
+	return m.id
+}
+
+// Trace returns the timeline of the message's passages if it was sent while
+// its engine's TraceMsgs was true and nil otherwise.
+func (m *Message) Trace() *MsgTrace {
+	return m.trace
+}
+
 // Clone returns a shallow copy of this message except the copy has a clone
-// of the message's transaction.
+// of the message's transaction.  The copy is assigned its own id when it is
+// first sent.
 func (m *Message) Clone() *Message {
 	clone := *m
-	clone.Trans = m.Trans.Clone()
+	if m.Trans != nil {
+		clone.Trans = m.Trans.Clone()
+	}
+	clone.id, clone.cloneOf, clone.trace = 0, m.id, nil
 	return &clone
 }
 
@@ -113,7 +178,28 @@ func (m *Message) Clone() *Message {
 //
 // If the message Dir is down, the message retraces its upward path sending
 // itself to each previous owner until it reaches its original sender.
+//
+// Messages addressed to a group of agents are sent as clones to each agent
+// in the group (see NewMsgTo).
+//
+// Messages sent by tickers during a parallel Tick phase are delivered after
+// the phase (see Engine.TickWorkers).  If the engine's AsyncMsgs is true,
+// SendOn returns before the message is delivered.
 func (m *Message) SendOn() {
+	e := m.eng
+	if e != nil && e.deferSend(m) {
+		return
+	} else if m.to != nil {
+		e.fanOut(m)
+		return
+	} else if e != nil && e.enqueue(m) {
+		return
+	}
+	m.deliver()
+}
+
+// deliver passes the message to the next agent on its path.
+func (m *Message) deliver() {
 	if !m.hasDest {
 		m.autoSetNext()
 	}
@@ -127,9 +213,12 @@ func (m *Message) SendOn() {
 	next := m.pathStack[len(m.pathStack)-1]
 	m.PrevOwner, m.Owner = m.Owner, next
 
-	notifyListeners(m)
+	if m.eng != nil {
+		m.eng.recordHop(m)
+		m.eng.notifyMsg(m)
+	}
 	m.hasDest = false
-	next.Receive(m)
+	m.eng.receive(next, m)
 }
 
 // SetNext allows manual specification of the next message receiver.
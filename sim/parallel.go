@@ -0,0 +1,106 @@
+package sim
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// tick runs the Tick phase, concurrently if the engine has TickWorkers > 1.
+// In parallel mode, the messages sent by each ticker's Tick are queued in
+// its outbox in the order they were sent and, after all tickers return, the
+// outboxes are delivered in ticker order.  The outbox is that of the ticker
+// the sending goroutine is running, whoever owns the message; a message
+// sent from any other goroutine causes a panic.  Panics in tickers are
+// re-raised on the engine's goroutine after all tickers return.
+func (e *Engine) tick() {
+	if e.TickWorkers < 2 {
+		for _, t := range e.tickers {
+			if e.deployed(t) {
+				t.Tick()
+			}
+		}
+		return
+	}
+
+	tickers := []Ticker{}
+	for _, t := range e.tickers {
+		if e.deployed(t) {
+			tickers = append(tickers, t)
+		}
+	}
+	outboxes := make([][]*Message, len(tickers))
+	panics := make([]interface{}, len(tickers))
+	e.outbox = map[uint64]**[]*Message{}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < e.TickWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// box is set to the current ticker's outbox before its Tick
+			var box *[]*Message
+			id := goid()
+			e.outboxMu.Lock()
+			e.outbox[id] = &box
+			e.outboxMu.Unlock()
+			for i := range jobs {
+				func() {
+					defer func() { panics[i] = recover() }()
+					box = &outboxes[i]
+					tickers[i].Tick()
+				}()
+			}
+		}()
+	}
+	for i := range tickers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	e.outbox = nil
+
+	for _, p := range panics {
+		if p != nil {
+			panic(p)
+		}
+	}
+	for _, msgs := range outboxes {
+		for _, m := range msgs {
+			m.SendOn()
+		}
+	}
+}
+
+// deferSend queues message m in the outbox of the ticker running on the
+// calling goroutine for delivery after the current parallel Tick phase (see
+// tick) and returns true.  It returns false if no parallel Tick phase is
+// running.
+func (e *Engine) deferSend(m *Message) bool {
+	if e.outbox == nil {
+		return false
+	}
+	e.outboxMu.Lock()
+	box, ok := e.outbox[goid()]
+	e.outboxMu.Unlock()
+	if !ok {
+		panic("sim: message sent from a goroutine other than a ticker's during parallel tick")
+	}
+	**box = append(**box, m)
+	return true
+}
+
+// goid returns the id of the calling goroutine.
+func goid() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// the trace starts with "goroutine <id> [...]"
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	id, err := strconv.ParseUint(string(buf[:bytes.IndexByte(buf, ' ')]), 10, 64)
+	if err != nil {
+		panic("sim: cannot parse goroutine id: " + err.Error())
+	}
+	return id
+}
@@ -0,0 +1,77 @@
+package sim
+
+import (
+	"sort"
+)
+
+// Phase identifies one of the phases of a simulation time step.  Every time
+// step runs, in order, the events due at its beginning (see Schedule), then
+// the Decay, Tick, Resolve, Tock and Report phases, then the events due
+// before the next time step.
+type Phase int
+
+const (
+	// EventPhase is the phase in which scheduled events fire (and in which
+	// agents are registered before the simulation runs).  Agents are never
+	// asked for their priority in it.
+	EventPhase Phase = iota
+	DecayPhase
+	TickPhase
+	ResolvePhase
+	TockPhase
+	ReportPhase
+)
+
+func (p Phase) String() string {
+	switch p {
+	case EventPhase:
+		return "event"
+	case DecayPhase:
+		return "decay"
+	case TickPhase:
+		return "tick"
+	case ResolvePhase:
+		return "resolve"
+	case TockPhase:
+		return "tock"
+	case ReportPhase:
+		return "report"
+	}
+	return "unknown"
+}
+
+func (p Phase) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Phase returns the phase the simulation is currently in.
+func (e *Engine) Phase() Phase {
+	return e.phase
+}
+
+// Prioritizer is implemented by agents that need to run before or after
+// other agents within phases.  Agents run in order of increasing priority
+// within each phase; agents with equal priorities run in the order they
+// were registered.  Agents that don't implement Prioritizer have priority
+// zero in every phase.
+type Prioritizer interface {
+	Priority(Phase) int
+}
+
+func priority(a interface{}, p Phase) int {
+	if pr, ok := a.(Prioritizer); ok {
+		return pr.Priority(p)
+	}
+	return 0
+}
+
+// insertPhase returns s with x inserted after all agents with a priority
+// in phase p lower than or equal to x's.
+func insertPhase[T any](s []T, x T, p Phase) []T {
+	pri := priority(x, p)
+	i := sort.Search(len(s), func(i int) bool { return priority(s[i], p) > pri })
+	s = append(s, x)
+	copy(s[i+1:], s[i:])
+	s[i] = x
+	return s
+}
@@ -0,0 +1,40 @@
+package sim
+
+// enqueue queues message m for asynchronous delivery (see
+// Engine.AsyncMsgs) and returns true.  It returns false if the engine
+// delivers messages synchronously.
+func (e *Engine) enqueue(m *Message) bool {
+	if !e.AsyncMsgs {
+		return false
+	}
+	e.inFlight++
+	if e.MsgLatency > 0 {
+		e.ScheduleIn(e.MsgLatency, func() {
+			e.inFlight--
+			m.deliver()
+		})
+	} else {
+		e.msgQueue = append(e.msgQueue, m)
+	}
+	return true
+}
+
+// flushMsgs delivers all queued messages - including those sent while
+// delivering - in the order they were sent.
+func (e *Engine) flushMsgs() {
+	for len(e.msgQueue) > 0 {
+		m := e.msgQueue[0]
+		e.msgQueue[0] = nil
+		e.msgQueue = e.msgQueue[1:]
+		e.inFlight--
+		m.deliver()
+	}
+	e.msgQueue = nil
+}
+
+// enterPhase delivers the messages queued during the current phase and
+// then begins phase p.
+func (e *Engine) enterPhase(p Phase) {
+	e.flushMsgs()
+	e.phase = p
+}
@@ -0,0 +1,42 @@
+package sim
+
+import (
+	"math/rand/v2"
+)
+
+// Rand returns agent a's private random number stream.  Each agent's stream
+// is derived from the engine's Seed and the agent's id, so a simulation's
+// random draws are reproducible and one agent's draws never affect
+// another's.  Repeated calls return the same stream.  Agents should only
+// call Rand after their id has been set (e.g. in Start).
+func (e *Engine) Rand(a Agent) *rand.Rand {
+	e.rngMu.Lock()
+	defer e.rngMu.Unlock()
+	if e.rngs == nil {
+		e.rngs = map[int]*rngStream{}
+	}
+	if s, ok := e.rngs[a.Id()]; ok {
+		return s.r
+	}
+
+	src := rand.NewPCG(uint64(e.Seed), mix(uint64(e.Seed)^mix(uint64(a.Id()))))
+	s := &rngStream{src: src, r: rand.New(src)}
+	e.rngs[a.Id()] = s
+	return s.r
+}
+
+// rngStream keeps an agent's stream together with its source so the
+// stream's state can be checkpointed.
+type rngStream struct {
+	src *rand.PCG
+	r   *rand.Rand
+}
+
+// mix is the splitmix64 finalizer; it scrambles x so that nearby seeds and
+// ids produce unrelated streams.
+func mix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
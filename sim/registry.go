@@ -0,0 +1,85 @@
+package sim
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// registry holds the agent types registered with Register.
+var registry = &typeRegistry{}
+
+// Register makes the agent type of a (a struct value or pointer) available
+// to all loaders under its import path (e.g.
+// "github.com/rwcarlsen/goclus/agents/fac.Fac") and the given short
+// aliases (e.g. "fac").  It is intended to be called from the init function
+// of the package that defines the agent type, so that importing the package
+// is enough to use its agents in input files.  Register panics if an alias
+// is already used for a different type.
+func Register(a interface{}, aliases ...string) {
+	registry.add(a, aliases)
+}
+
+// typeRegistry maps agent type import paths and aliases to agent types.
+type typeRegistry struct {
+	mu      sync.RWMutex
+	types   map[string]reflect.Type // by import path
+	aliases map[string]string       // import paths by alias
+}
+
+func (r *typeRegistry) add(a interface{}, aliases []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.types == nil {
+		r.types = map[string]reflect.Type{}
+		r.aliases = map[string]string{}
+	}
+
+	t := reflect.Indirect(reflect.ValueOf(a)).Type()
+	path := t.PkgPath() + "." + t.Name()
+	r.types[path] = t
+	for _, alias := range aliases {
+		if other, ok := r.aliases[alias]; ok && other != path {
+			panic("sim: agent type alias '" + alias + "' registered for both " + other + " and " + path)
+		}
+		r.aliases[alias] = path
+	}
+}
+
+// lookup returns the type registered under name (an import path or alias)
+// and its import path.
+func (r *typeRegistry) lookup(name string) (reflect.Type, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if path, ok := r.aliases[name]; ok {
+		name = path
+	}
+	t, ok := r.types[name]
+	return t, name, ok
+}
+
+// paths returns the import paths of all registered types.
+func (r *typeRegistry) paths() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	paths := []string{}
+	for path := range r.types {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// aliasesOf returns the sorted aliases of the type registered under the
+// import path.
+func (r *typeRegistry) aliasesOf(path string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	aliases := []string{}
+	for alias, p := range r.aliases {
+		if p == path {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
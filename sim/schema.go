@@ -0,0 +1,146 @@
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldSchema describes a prototype configuration field of an agent type.
+// It is declared with struct tags on the field, all optional:
+//
+//	Mass float64 `desc:"initial mass" units:"kg" min:"0" default:"100"`
+//
+// desc describes the field and units gives the (fixed) units of its value.
+// default is the value used if a prototype doesn't set the field, written
+// as in json input files (strings need not be quoted).  min and max are
+// inclusive bounds on numeric and duration (e.g. "1d") values.
+// required:"true" marks a field that every prototype must set.
+type FieldSchema struct {
+	// Name is the field's key in prototype Config entries.
+	Name     string
+	Type     reflect.Type
+	Desc     string
+	Units    string
+	Default  string
+	Min, Max string
+	Required bool
+	index    []int
+}
+
+// Schema returns the schema of every configurable field (see ConfigFields)
+// of the agent type registered under importPath or an alias.
+func (l *Loader) Schema(importPath string) ([]*FieldSchema, error) {
+	tp, _, ok := l.agentType(importPath)
+	if !ok {
+		return nil, errors.New("loader: no registered agent for import path '" + importPath + "'")
+	}
+	return schemaOf(tp), nil
+}
+
+func schemaOf(t reflect.Type) []*FieldSchema {
+	schema := []*FieldSchema{}
+	for _, f := range decodableFields(t) {
+		schema = append(schema, &FieldSchema{
+			Name:     jsonName(f),
+			Type:     f.Type,
+			Desc:     f.Tag.Get("desc"),
+			Units:    f.Tag.Get("units"),
+			Default:  f.Tag.Get("default"),
+			Min:      f.Tag.Get("min"),
+			Max:      f.Tag.Get("max"),
+			Required: f.Tag.Get("required") == "true",
+			index:    f.Index,
+		})
+	}
+	return schema
+}
+
+// defaultValue returns the field's default as generic json data.
+func (f *FieldSchema) defaultValue() interface{} {
+	if f.Type.Kind() == reflect.String {
+		return f.Default
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(f.Default), &v); err != nil {
+		return f.Default
+	}
+	return v
+}
+
+// Range returns the field's allowed range in interval notation or the
+// empty string if it is unbounded.
+func (f *FieldSchema) Range() string {
+	if f.Min == "" && f.Max == "" {
+		return ""
+	}
+	min, max := "-inf", "inf"
+	if f.Min != "" {
+		min = f.Min
+	}
+	if f.Max != "" {
+		max = f.Max
+	}
+	return "[" + min + ", " + max + "]"
+}
+
+// check returns an error if the field's value in agent a (a pointer to a
+// struct) is out of range.
+func (f *FieldSchema) check(a interface{}) error {
+	if f.Min == "" && f.Max == "" {
+		return nil
+	}
+	v := reflect.ValueOf(a).Elem().FieldByIndex(f.index)
+
+	var x float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		x = v.Float()
+	default:
+		return fmt.Errorf("range given for non-numeric type %v", f.Type)
+	}
+
+	outside := fmt.Errorf("value %v is outside of the allowed range %v", f.format(x), f.Range())
+	if f.Min != "" {
+		if min, err := f.parseBound(f.Min); err != nil {
+			return err
+		} else if x < min {
+			return outside
+		}
+	}
+	if f.Max != "" {
+		if max, err := f.parseBound(f.Max); err != nil {
+			return err
+		} else if x > max {
+			return outside
+		}
+	}
+	return nil
+}
+
+func (f *FieldSchema) parseBound(s string) (float64, error) {
+	if f.Type == durationType {
+		d, err := ParseDuration(s)
+		return float64(d), err
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range bound '%v'", s)
+	}
+	return x, nil
+}
+
+func (f *FieldSchema) format(x float64) string {
+	if f.Type == durationType {
+		return time.Duration(x).String()
+	}
+	return fmt.Sprint(x)
+}
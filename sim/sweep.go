@@ -0,0 +1,76 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Setting is a single prototype configuration value.
+type Setting struct {
+	Proto string
+	Field string
+	Value interface{}
+}
+
+func (s Setting) String() string {
+	return fmt.Sprintf("%v.%v=%v", s.Proto, s.Field, s.Value)
+}
+
+// SweepParam describes the values a prototype configuration field takes on
+// in a parameter sweep.  If Values is non-empty, they are used.  Otherwise
+// Steps evenly spaced values from From to To (inclusive) are used.
+type SweepParam struct {
+	Proto    string
+	Field    string
+	Values   []interface{}
+	From, To float64
+	Steps    int
+}
+
+func (p *SweepParam) values() ([]interface{}, error) {
+	if len(p.Values) > 0 {
+		return p.Values, nil
+	} else if p.Steps < 1 {
+		return nil, fmt.Errorf("loader: sweep of '%v.%v' needs Values or Steps >= 1", p.Proto, p.Field)
+	} else if p.Steps == 1 {
+		return []interface{}{p.From}, nil
+	}
+
+	vals := []interface{}{}
+	for i := 0; i < p.Steps; i++ {
+		vals = append(vals, p.From+float64(i)*(p.To-p.From)/float64(p.Steps-1))
+	}
+	return vals, nil
+}
+
+// SweepPoints expands the decoded sweep parameters into the Cartesian
+// product of their values.  Each returned point holds one setting per
+// sweep parameter in declaration order, with the last parameter varying
+// fastest.  Sweeps are ignored by LoadSim and Build; each point must be
+// applied via SetConfig to simulate it.
+func (l *Loader) SweepPoints() ([][]Setting, error) {
+	if len(l.Sweep) == 0 {
+		return nil, errors.New("loader: input has no sweep")
+	}
+
+	points := [][]Setting{{}}
+	for _, p := range l.Sweep {
+		if _, ok := l.Prototypes[p.Proto]; !ok {
+			return nil, errors.New("loader: sweep of unknown prototype '" + p.Proto + "'")
+		}
+		vals, err := p.values()
+		if err != nil {
+			return nil, err
+		}
+
+		var next [][]Setting
+		for _, pt := range points {
+			for _, v := range vals {
+				s := Setting{Proto: p.Proto, Field: p.Field, Value: v}
+				next = append(next, append(append([]Setting{}, pt...), s))
+			}
+		}
+		points = next
+	}
+	return points, nil
+}
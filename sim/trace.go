@@ -0,0 +1,102 @@
+package sim
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Hop records a single passage of a traced message from one agent to the
+// next (see Engine.TraceMsgs).
+type Hop struct {
+	// Time and Phase are the simulation time and phase of the passage.
+	Time  time.Time
+	Phase Phase
+	// Dir is "up" (toward the receiver) or "down" (back toward the sender).
+	Dir string
+	// PrevOwner is the name of the agent that sent the message on and Owner
+	// the name of the agent it was sent to.
+	PrevOwner   string
+	PrevOwnerId int
+	Owner       string
+	OwnerId     int
+}
+
+// MsgTrace is the timeline of all passages of a traced message.
+type MsgTrace struct {
+	Id int
+	// CloneOf is the id of the message this message was cloned from (if
+	// any).
+	CloneOf    int `json:",omitempty"`
+	Sender     string
+	SenderId   int
+	Receiver   string
+	ReceiverId int
+	// Rejection is the reason the message was rejected (if it was).
+	Rejection string `json:",omitempty"`
+	Hops      []*Hop
+}
+
+// MsgTraces returns the timelines of all messages sent while TraceMsgs was
+// true, in message id order.
+func (e *Engine) MsgTraces() []*MsgTrace {
+	return e.traces
+}
+
+// WriteMsgTraces writes the result of MsgTraces to the file fname as json.
+func (e *Engine) WriteMsgTraces(fname string) error {
+	traces := e.MsgTraces()
+	if traces == nil {
+		traces = []*MsgTrace{}
+	}
+	data, err := json.MarshalIndent(traces, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, data, 0644)
+}
+
+// recordHop assigns m an id when it is first sent and, if the engine traces
+// messages, records m's passage from its PrevOwner to its Owner.
+func (e *Engine) recordHop(m *Message) {
+	e.assignId(m)
+	if !e.TraceMsgs {
+		return
+	}
+
+	if m.trace == nil {
+		m.trace = &MsgTrace{
+			Id:         m.id,
+			CloneOf:    m.cloneOf,
+			Sender:     agentName(m.sender),
+			SenderId:   agentId(m.sender),
+			Receiver:   agentName(m.receiver),
+			ReceiverId: agentId(m.receiver),
+		}
+		e.traces = append(e.traces, m.trace)
+	}
+	m.trace.Hops = append(m.trace.Hops, &Hop{
+		Time:        e.Time(),
+		Phase:       e.phase,
+		Dir:         m.Dir.String(),
+		PrevOwner:   agentName(m.PrevOwner),
+		PrevOwnerId: agentId(m.PrevOwner),
+		Owner:       agentName(m.Owner),
+		OwnerId:     agentId(m.Owner),
+	})
+}
+
+// assignId assigns m the next message id unless it already has one.
+func (e *Engine) assignId(m *Message) {
+	if m.id == 0 {
+		e.nextMsgId++
+		m.id = e.nextMsgId
+	}
+}
+
+func agentName(a Agent) string {
+	if a == nil {
+		return ""
+	}
+	return a.Name()
+}
@@ -0,0 +1,301 @@
+package sim
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// CommodTrader is implemented by agents that trade commodities through
+// market services registered under the commodities' names.
+type CommodTrader interface {
+	// Commods returns the names of the commodities the agent trades.
+	Commods() []string
+}
+
+// InputError describes a single problem found in decoded input.
+type InputError struct {
+	// Path is the json path of the offending input value, e.g.
+	// `Agents[2].ParentName` or `Prototypes["src"].Config.InSize`.
+	Path string
+	Msg  string
+}
+
+func (e *InputError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// InputErrors is the list of all problems found by Validate.
+type InputErrors []*InputError
+
+func (es InputErrors) Error() string {
+	msgs := []string{fmt.Sprintf("loader: %v problem(s) in input", len(es))}
+	for _, e := range es {
+		msgs = append(msgs, "    "+e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the decoded input for problems that would prevent the
+// simulation from being built or run correctly (including violations of
+// the agent types' configuration schemas).  All problems found are
+// returned together as InputErrors.  Validate is called by Build and
+// Resume, but may also be called directly after Decode.
+func (l *Loader) Validate() error {
+	var errs InputErrors
+	seen := map[InputError]bool{}
+	fail := func(path, format string, args ...interface{}) {
+		// inherited problems are reported once, at the base prototype
+		e := InputError{Path: path, Msg: fmt.Sprintf(format, args...)}
+		if !seen[e] {
+			seen[e] = true
+			errs = append(errs, &e)
+		}
+	}
+
+	if l.Engine == nil {
+		fail("Engine", "missing")
+	} else {
+		if l.Engine.Step <= 0 {
+			fail("Engine.Step", "must be positive")
+		}
+		if l.Engine.Duration <= 0 {
+			fail("Engine.Duration", "must be positive")
+		}
+	}
+
+	// prototypes - in sorted order so problems are reported consistently
+	ids := sortedKeys(l.Prototypes)
+	protos := map[string]Agent{}
+	for _, id := range ids {
+		path := fmt.Sprintf("Prototypes[%q]", id)
+		if l.Prototypes[id] == nil {
+			fail(path, "missing")
+			continue
+		}
+		info, from, err := l.resolveProto(id)
+		if err != nil {
+			fail(path+".Base", "%v", strings.TrimPrefix(err.Error(), "loader: "))
+		} else if p := l.validateProto(id, info, from, fail); p != nil {
+			protos[id] = p
+		}
+	}
+
+	// agents
+	agents := l.expandAgents(fail)
+	byName := map[string]int{}
+	services := map[string]bool{}
+	for i, info := range agents {
+		path := info.path
+		if info.Name == "" {
+			fail(path+".Name", "missing")
+		} else if j, ok := byName[info.Name]; ok {
+			fail(path+".Name", "duplicate of %v.Name %q", agents[j].path, info.Name)
+		} else {
+			byName[info.Name] = i
+		}
+		if _, ok := l.Prototypes[info.ProtoId]; !ok {
+			fail(path+".ProtoId", "no prototype with id %q", info.ProtoId)
+		}
+		if info.Start < 0 {
+			fail(path+".Start", "must not be negative")
+		}
+		if info.Lifetime < 0 {
+			fail(path+".Lifetime", "must not be negative")
+		}
+		if info.IsService {
+			services[info.Name] = true
+		}
+	}
+
+	for _, info := range agents {
+		if info.ParentName == "" {
+			continue
+		} else if j, ok := byName[info.ParentName]; !ok {
+			fail(info.path+".ParentName", "no agent named %q", info.ParentName)
+		} else if info.Start < agents[j].Start {
+			fail(info.path+".Start", "before the start of parent %q", info.ParentName)
+		}
+	}
+	for _, cycle := range parentCycles(agents, byName) {
+		names := []string{}
+		for _, i := range cycle {
+			names = append(names, agents[i].Name)
+		}
+		names = append(names, names[0])
+		fail(agents[cycle[0]].path+".ParentName", "parent cycle %v", strings.Join(names, " -> "))
+	}
+
+	// commodities traded by deployed agents need markets
+	used := map[string]bool{}
+	for _, info := range agents {
+		used[info.ProtoId] = true
+	}
+	for _, id := range ids {
+		t, ok := protos[id].(CommodTrader)
+		if !ok || !used[id] {
+			continue
+		}
+		for _, commod := range t.Commods() {
+			if !services[commod] {
+				fail(fmt.Sprintf("Prototypes[%q]", id), "commodity %q has no market service", commod)
+			}
+		}
+	}
+
+	for i, p := range l.Sweep {
+		path := fmt.Sprintf("Sweep[%v]", i)
+		if _, ok := l.Prototypes[p.Proto]; !ok {
+			fail(path+".Proto", "no prototype with id %q", p.Proto)
+		} else if info, _, err := l.resolveProto(p.Proto); err == nil {
+			if _, ok := l.configField(info.ImportPath, p.Field); !ok {
+				fail(path+".Field", "unknown field %q", p.Field)
+			}
+		}
+		if _, err := p.values(); err != nil {
+			fail(path, "needs Values or Steps >= 1")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateProto checks the effective info of prototype id (see
+// resolveProto) and returns a new, configured instance of it or nil if it
+// has an unknown type.
+func (l *Loader) validateProto(id string, info *ProtoInfo, from map[string]string, fail func(string, string, ...interface{})) Agent {
+	path := fmt.Sprintf("Prototypes[%q]", id)
+	tp, _, ok := l.agentType(info.ImportPath)
+	if info.ImportPath == "" {
+		fail(path+".ImportPath", "missing")
+		return nil
+	} else if !ok {
+		fail(path+".ImportPath", "no registered agent type %q", info.ImportPath)
+		return nil
+	}
+	p, ok := reflect.New(tp).Interface().(Agent)
+	if !ok {
+		fail(path+".ImportPath", "type %q does not implement sim.Agent", info.ImportPath)
+		return nil
+	}
+
+	configPath := func(key string) string {
+		if src := from[key]; src != "" {
+			return fmt.Sprintf("Prototypes[%q].Config", src)
+		}
+		return path + ".Config"
+	}
+
+	for _, key := range sortedKeys(info.Config) {
+		cpath := configPath(key)
+		fpath := cpath + "." + key
+		if _, ok := l.configField(info.ImportPath, key); !ok {
+			fail(fpath, "unknown field for type %q", info.ImportPath)
+			continue
+		}
+		err := decodeJSON(cpath, map[string]interface{}{key: info.Config[key]}, p)
+		if errs, ok := err.(InputErrors); ok {
+			for _, e := range errs {
+				fail(e.Path, "%v", e.Msg)
+			}
+		} else if err != nil {
+			fail(fpath, "%v", err)
+		}
+	}
+
+	for _, f := range schemaOf(tp) {
+		key, ok := configKey(info.Config, f.Name)
+		if !ok && f.Required {
+			fail(path+".Config", "missing required field %q", f.Name)
+		} else if err := f.check(p); err != nil && ok {
+			fail(configPath(key)+"."+key, "%v", err)
+		} else if err != nil {
+			fail(path+".Config", "%v: %v", f.Name, err)
+		}
+	}
+	return p
+}
+
+// configField returns the configurable field of the agent type registered
+// under importPath (or an alias) that is decoded from the json key name.
+func (l *Loader) configField(importPath, name string) (reflect.StructField, bool) {
+	if tp, _, ok := l.agentType(importPath); ok {
+		return fieldByJSONName(tp, name)
+	}
+	return reflect.StructField{}, false
+}
+
+// decodableFields returns the exported fields of struct type t that
+// encoding/json decodes into.
+func decodableFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for _, f := range reflect.VisibleFields(t) {
+		if f.IsExported() && !f.Anonymous && f.Tag.Get("json") != "-" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// fieldByJSONName returns the field of struct type t that is decoded from
+// the json key name (using the same case-insensitive matching as
+// encoding/json).
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for _, f := range decodableFields(t) {
+		if strings.EqualFold(jsonName(f), name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonName(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// parentCycles returns the indices (in parent order) of every cycle in the
+// parent relationships of agents.
+func parentCycles(agents []*AgentInfo, byName map[string]int) [][]int {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(agents))
+	var cycles [][]int
+	for i := range agents {
+		chain := []int{}
+		j := i
+		for {
+			if state[j] == done {
+				break
+			} else if state[j] == visiting {
+				for k, c := range chain {
+					if c == j {
+						cycles = append(cycles, chain[k:])
+						break
+					}
+				}
+				break
+			}
+			state[j] = visiting
+			chain = append(chain, j)
+
+			next, ok := byName[agents[j].ParentName]
+			if !ok {
+				break
+			}
+			j = next
+		}
+		for _, c := range chain {
+			state[c] = done
+		}
+	}
+	return cycles
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/rwcarlsen/goclus/rsrc"
 )
 
+// ErrUnrecorded is returned by Approve for transactions without a notifier.
+var ErrUnrecorded = errors.New("trans: approved transaction has no notifier and is not recorded")
+
 // TransType indicates a transaction's type (e.g. offer or request).
 type TransType int
 
@@ -16,8 +19,6 @@ const (
 	Request
 )
 
-var listeners []Listener
-
 // Listener is implemented by entities that desire to receive notifications
 // every time a transaction is approved and executed between any two
 // simulation agents.
@@ -25,22 +26,45 @@ type Listener interface {
 	TransNotify(*Transaction)
 }
 
-// ListenAll adds l to a global list of agents that receive notifications
-// for every approved transaction (usually used by "special" agents e.g.
-// book-keeper, etc.).
-// These notifications are sent when the Approve method is called -
-// before Approve returns and directly after the resource transfer.
-// Simulation execution continues only after l's TransNotify method returns.
-func ListenAll(l Listener) {
-	listeners = append(listeners, l)
+// Notifier holds a set of listeners that receive notifications for every
+// approved transaction associated with it via SetNotifier (usually used by
+// "special" agents e.g. book-keeper, etc.).  Simulation engines each own
+// a Notifier so that listeners of independent simulations don't interfere.
+type Notifier struct {
+	listeners []*Listener
+}
+
+// Listen adds l to the notifier's listeners.  Calling the returned function
+// removes l.
+func (n *Notifier) Listen(l Listener) (unsubscribe func()) {
+	p := &l
+	n.listeners = append(n.listeners, p)
+	return func() {
+		// rebuild rather than modify in place in case Notify is in progress
+		var rest []*Listener
+		for _, other := range n.listeners {
+			if other != p {
+				rest = append(rest, other)
+			}
+		}
+		n.listeners = rest
+	}
 }
 
-func notifyListeners(t *Transaction) {
-	for _, l := range listeners {
-		l.TransNotify(t)
+// Notify sends t to all of the notifier's listeners.
+func (n *Notifier) Notify(t *Transaction) {
+	for _, l := range n.listeners {
+		(*l).TransNotify(t)
 	}
 }
 
+// NotifierHolder is implemented by suppliers and requesters that know the
+// notifier their transactions are associated with (e.g. agents registered
+// with a sim.Engine).
+type NotifierHolder interface {
+	TransNotifier() *Notifier
+}
+
 // Supplier is implemented by all agents that are able to send resources to
 // other agents via matched/approved transactions.
 type Supplier interface {
@@ -62,6 +86,7 @@ type Requester interface {
 type Transaction struct {
 	tp       TransType
 	res      rsrc.Resource
+	notifier *Notifier
 	Sup      Supplier
 	Req      Requester
 	Manifest []rsrc.Resource
@@ -108,12 +133,41 @@ func (t *Transaction) Type() TransType {
 
 // Approve executes the resource transfer: resources are removed from the
 // supplier and given to the requester.
-// All transaction notification listeners are also notified immediately
-// following the resource transfer before Approve returns.
-func (t *Transaction) Approve() {
+// The listeners of the transaction's notifier are also notified
+// immediately following the resource transfer before Approve returns.
+// Simulation execution continues only after all listeners' TransNotify
+// methods return.  If no notifier was set via SetNotifier, the notifier of
+// the supplier or requester (see NotifierHolder) is used.  Transactions
+// without any notifier are still executed, but ErrUnrecorded is returned.
+func (t *Transaction) Approve() error {
 	t.Sup.RemoveResource(t)
 	t.Req.AddResource(t)
-	notifyListeners(t)
+
+	n := t.notifier
+	if n == nil {
+		n = notifierOf(t.Sup)
+	}
+	if n == nil {
+		n = notifierOf(t.Req)
+	}
+	if n == nil {
+		return ErrUnrecorded
+	}
+	n.Notify(t)
+	return nil
+}
+
+func notifierOf(x interface{}) *Notifier {
+	if h, ok := x.(NotifierHolder); ok {
+		return h.TransNotifier()
+	}
+	return nil
+}
+
+// SetNotifier sets the notifier whose listeners are notified when the
+// transaction is approved.
+func (t *Transaction) SetNotifier(n *Notifier) {
+	t.notifier = n
 }
 
 // Resource returns the resource associated with this transaction (not a